@@ -0,0 +1,299 @@
+// audit.go
+// Audit log: every operation that writes to a volume or device appends one
+// JSON line saying who wrote what to which medium and how it went, and
+// "mkfat log" reads it back.
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"mkfat/retrodfrg"
+)
+
+// auditLogFile is the --audit-log flag; empty means defaultAuditLog().
+var auditLogFile string
+
+// defaultAuditLog is $XDG_STATE_HOME/mkfat/audit.jsonl, the state directory
+// defaulting to ~/.local/state as the XDG base directory spec says.
+func defaultAuditLog() string {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" || !filepath.IsAbs(dir) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "mkfat", "audit.jsonl")
+}
+
+func auditLogPath() string {
+	if auditLogFile != "" {
+		return auditLogFile
+	}
+	return defaultAuditLog()
+}
+
+// Outcomes of an audited operation.
+const (
+	auditOK          = "ok"
+	auditFailed      = "failed"
+	auditInterrupted = "interrupted"
+)
+
+// auditDevice is the identity of the medium written.
+type auditDevice struct {
+	Model    string `json:"model,omitempty"`
+	Vendor   string `json:"vendor,omitempty"`
+	Serial   string `json:"serial,omitempty"`
+	Size     int64  `json:"size"`
+	Previous string `json:"previous,omitempty"` // what detectFilesystem found before the write
+}
+
+// auditEntry is one line of the audit log. Times are wall-clock times,
+// also in reproducible mode.
+type auditEntry struct {
+	Time       string       `json:"time"`
+	User       string       `json:"user"`
+	SudoUser   string       `json:"sudo_user,omitempty"`
+	Host       string       `json:"host"`
+	Command    string       `json:"command"` // format, img2dev, scan, put, label, defrag, check or undelete
+	Args       []string     `json:"args"`
+	Target     string       `json:"target"`
+	Device     *auditDevice `json:"device,omitempty"`
+	Image      string       `json:"image,omitempty"`  // source image of img2dev
+	SHA256     string       `json:"sha256,omitempty"` // of the image written
+	Outcome    string       `json:"outcome"`
+	Error      string       `json:"error,omitempty"`
+	BadSectors int          `json:"bad_sectors"`
+	Elapsed    float64      `json:"elapsed"` // seconds
+
+	start time.Time
+}
+
+// newAuditEntry starts the entry of an operation on target.
+func newAuditEntry(command, target string) *auditEntry {
+	e := &auditEntry{Command: command, Target: target, Args: os.Args, start: time.Now()}
+	if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	} else {
+		e.User = os.Getenv("USER")
+	}
+	e.SudoUser = os.Getenv("SUDO_USER")
+	e.Host, _ = os.Hostname()
+	return e
+}
+
+// newVolumeAudit starts the entry of a command that changes the volume at
+// target in place. Devices get their identity recorded, images do not.
+func newVolumeAudit(command, target string) *auditEntry {
+	e := newAuditEntry(command, target)
+	if st, err := os.Stat(target); err == nil && st.Mode()&os.ModeDevice != 0 {
+		e.identify(newDeviceGuard(), target)
+	}
+	return e
+}
+
+// identify records the identity of the device about to be written.
+func (e *auditEntry) identify(g *deviceGuard, device string) {
+	id := g.identify(device)
+	e.Device = &auditDevice{Model: id.Model, Vendor: id.Vendor, Serial: id.Serial, Size: id.Size}
+	if id.Contents.Type != "" {
+		e.Device.Previous = id.Contents.String()
+	}
+}
+
+// finish sets the outcome from err and appends the entry to the log. A log
+// that cannot be written is reported but does not fail the operation,
+// which has already happened.
+func (e *auditEntry) finish(err error) {
+	e.Time = e.start.UTC().Format(time.RFC3339)
+	e.Elapsed = time.Since(e.start).Seconds()
+	switch {
+	case err == nil:
+		e.Outcome = auditOK
+	case errors.Is(err, retrodfrg.ErrInterrupted):
+		e.Outcome = auditInterrupted
+	default:
+		e.Outcome = auditFailed
+		e.Error = err.Error()
+	}
+	if werr := appendAuditEntry(auditLogPath(), e); werr != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: audit log: %v\n", werr)
+	}
+}
+
+func appendAuditEntry(path string, e *auditEntry) error {
+	if path == "" {
+		return errors.New("no home directory for the default log; set --audit-log")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	// One write per line, so concurrent runs do not interleave.
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// hashFile returns the SHA-256 of the first n bytes of path.
+func hashFile(path string, n int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, io.LimitReader(f, n)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readAuditLog reads every entry of the log at path. Lines that do not
+// parse are skipped with a warning rather than hiding the rest.
+func readAuditLog(path string) ([]auditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []auditEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var e auditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: %s:%d: %v\n", path, n, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+/* ===================== log command ===================== */
+
+func newLogCmd() *cobra.Command {
+	var (
+		target, serial, command, outcome, since string
+		last                                    int
+		asJSON                                  bool
+	)
+	cmd := &cobra.Command{
+		Use:   "log",
+		Short: "Show the audit log of the commands that write to a volume or device",
+		Long: "Show the audit log that format, copy img2dev, scan --write, put, label,\n" +
+			"defrag, check --repair and undelete --in-place append to.\n" +
+			"The log is JSON lines at --audit-log, by default\n" +
+			"$XDG_STATE_HOME/mkfat/audit.jsonl (~/.local/state/mkfat/audit.jsonl).",
+		Args: cobra.NoArgs,
+		RunE: func(_ *cobra.Command, _ []string) error {
+			var after time.Time
+			if since != "" {
+				var err error
+				if after, err = time.Parse(time.DateOnly, since); err != nil {
+					if after, err = time.Parse(time.RFC3339, since); err != nil {
+						return fmt.Errorf("--since wants YYYY-MM-DD or an RFC 3339 time")
+					}
+				}
+			}
+			path := auditLogPath()
+			entries, err := readAuditLog(path)
+			if errors.Is(err, os.ErrNotExist) {
+				fmt.Fprintf(os.Stderr, "no audit log at %s\n", path)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			var shown []auditEntry
+			for _, e := range entries {
+				switch {
+				case target != "" && e.Target != target:
+				case serial != "" && (e.Device == nil || !strings.EqualFold(e.Device.Serial, serial)):
+				case command != "" && e.Command != command:
+				case outcome != "" && e.Outcome != outcome:
+				case !after.IsZero() && !entryAfter(e, after):
+				default:
+					shown = append(shown, e)
+				}
+			}
+			if last > 0 && len(shown) > last {
+				shown = shown[len(shown)-last:]
+			}
+
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				for _, e := range shown {
+					if err := enc.Encode(e); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			fmt.Printf("%-20s  %-10s  %-8s  %-18s  %-16s  %8s  %-11s  %4s  %s\n",
+				"TIME", "USER", "COMMAND", "TARGET", "SERIAL", "SIZE", "OUTCOME", "BAD", "SHA-256")
+			for _, e := range shown {
+				ser, size := "-", "-"
+				if e.Device != nil {
+					if e.Device.Serial != "" {
+						ser = e.Device.Serial
+					}
+					size = human(e.Device.Size)
+				}
+				sum := "-"
+				if len(e.SHA256) >= 16 {
+					sum = e.SHA256[:16]
+				}
+				who := e.User
+				if e.SudoUser != "" {
+					who = e.SudoUser
+				}
+				fmt.Printf("%-20s  %-10s  %-8s  %-18s  %-16s  %8s  %-11s  %4d  %s\n",
+					e.Time, who, e.Command, e.Target, ser, size, e.Outcome, e.BadSectors, sum)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&target, "target", "", "only entries for this image or device path")
+	cmd.Flags().StringVar(&serial, "serial", "", "only entries for the device with this serial")
+	cmd.Flags().StringVar(&command, "command", "", "only entries of this command: format|img2dev|scan|put|label|defrag|check|undelete")
+	cmd.Flags().StringVar(&outcome, "outcome", "", "only entries with this outcome: ok|failed|interrupted")
+	cmd.Flags().StringVar(&since, "since", "", "only entries from this date (YYYY-MM-DD) or time (RFC 3339) on")
+	cmd.Flags().IntVar(&last, "last", 0, "only the last N matching entries")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the matching entries as JSON lines")
+	return cmd
+}
+
+func entryAfter(e auditEntry, t time.Time) bool {
+	et, err := time.Parse(time.RFC3339, e.Time)
+	return err == nil && !et.Before(t)
+}
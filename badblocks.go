@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* ===================== Bad block lists ===================== */
+
+// readBadBlocks reads a bad block list: one block number per line, as
+// written by badblocks(8) or by --badblocks-out. Blank lines and "#"
+// comments are ignored. Each block of blockSize bytes is expanded to the
+// absolute 512-byte sectors it covers.
+func readBadBlocks(path string, blockSize int64) ([]int64, error) {
+	if blockSize < 512 || blockSize%512 != 0 {
+		return nil, fmt.Errorf("bad block size %d must be a multiple of 512", blockSize)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	per := blockSize / 512
+	out := []int64{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		b, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || b < 0 {
+			return nil, fmt.Errorf("%s:%d: %q is not a block number", path, line, text)
+		}
+		for s := b * per; s < (b+1)*per; s++ {
+			out = append(out, s)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return sortedSectors(out), nil
+}
+
+// writeBadSectors writes absolute 512-byte sector numbers, one per line,
+// in a form readBadBlocks accepts with the default block size.
+func writeBadSectors(path string, sectors []int64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "# mkfat bad sectors: absolute 512-byte sector numbers (%d)\n", len(sectors))
+	for _, s := range sectors {
+		fmt.Fprintln(w, s)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sortedSectors sorts sector numbers and drops duplicates.
+func sortedSectors(s []int64) []int64 {
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	out := s[:0]
+	for i, x := range s {
+		if i == 0 || x != s[i-1] {
+			out = append(out, x)
+		}
+	}
+	return out
+}
+
+// checkBadSectorsUsable fails when a bad sector falls where the file system
+// cannot work around it: the reserved area, the FATs, the root directory or
+// past the end of the volume. Like DOS, such media is unusable.
+func checkBadSectorsUsable(ft FATType, g geom, fatSecs, rootSecs uint32, totalSectors int64, sectors []int64) error {
+	firstData := int64(g.ReservedSectors) + int64(g.NumFATs)*int64(fatSecs) + int64(rootSecs)
+	if ft == FAT32 {
+		firstData += int64(g.RootCluster-1) * int64(g.SectorsPerCluster) // up to the end of the root cluster
+	}
+	for _, s := range sectors {
+		switch {
+		case s < firstData:
+			return fmt.Errorf("bad sector %d is in the system area (sectors 0-%d); the media is unusable", s, firstData-1)
+		case s >= totalSectors:
+			return fmt.Errorf("bad sector %d is past the end of the volume (%d sectors)", s, totalSectors)
+		}
+	}
+	return nil
+}
+
+// badClusterCount returns how many distinct data clusters the bad sectors
+// fall into, i.e. how many clusters marking them bad takes from the volume.
+func badClusterCount(g geom, fatSecs, rootSecs uint32, sectors []int64) int {
+	firstData := int64(g.ReservedSectors) + int64(g.NumFATs)*int64(fatSecs) + int64(rootSecs)
+	seen := map[int64]bool{}
+	for _, s := range sectors {
+		if s >= firstData {
+			seen[(s-firstData)/int64(g.SectorsPerCluster)] = true
+		}
+	}
+	return len(seen)
+}
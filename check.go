@@ -0,0 +1,627 @@
+// check.go
+// Consistency checker for FAT12/16/32 images and devices. Read-only unless
+// --repair is given; the repair pass itself lives in repair.go.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Issue severities. Only errors affect the exit code.
+const (
+	sevError   = "error"
+	sevWarning = "warning"
+	sevInfo    = "info"
+)
+
+// Exit codes of the check command, following fsck(8). Failures to run the
+// checker at all exit with 2, like every other mkfat command.
+const (
+	checkExitClean     = 0 // no errors (warnings may be present)
+	checkExitCorrected = 1 // errors were found and repaired
+	checkExitErrors    = 4 // errors were left uncorrected
+)
+
+// checkIssue is one problem found by the checker.
+type checkIssue struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	Path     string `json:"path,omitempty"`
+	Cluster  uint32 `json:"cluster,omitempty"`
+	Message  string `json:"message"`
+}
+
+// checkReport is the structured result of a check run.
+type checkReport struct {
+	Target       string        `json:"target"`
+	FATType      int           `json:"fat_type"`
+	ClusterBytes int64         `json:"cluster_bytes"`
+	Clusters     uint32        `json:"clusters"`
+	FreeClusters uint32        `json:"free_clusters"`
+	BadClusters  uint32        `json:"bad_clusters"`
+	LostClusters uint32        `json:"lost_clusters"`
+	Files        int           `json:"files"`
+	FileBytes    int64         `json:"file_bytes"`
+	Dirs         int           `json:"directories"`
+	Errors       int           `json:"errors"`
+	Warnings     int           `json:"warnings"`
+	Issues       []checkIssue  `json:"issues"`
+	Repair       *repairReport `json:"repair,omitempty"`
+}
+
+// repairReport describes a repair run: what was done, which sectors it
+// touched and how many errors a re-check still finds.
+type repairReport struct {
+	DryRun          bool            `json:"dry_run"`
+	Actions         []string        `json:"actions"`
+	Sectors         []plannedSector `json:"sectors"`
+	RemainingErrors int             `json:"remaining_errors"`
+}
+
+// entryRef locates the short entry of a file or directory: the first
+// cluster of its directory (0 for the root) and its slots there.
+type entryRef struct {
+	Dir     uint32
+	Slot    int
+	LFNSlot int
+	Path    string
+	IsDir   bool
+	Size    uint32
+}
+
+// chainFix describes how to truncate a damaged chain during repair.
+type chainFix struct {
+	entryRef
+	Kind  string   // "cross-link" or "size"
+	Chain []uint32 // the chain as found
+	Keep  int      // clusters of Chain to keep
+	Free  []uint32 // clusters past Keep owned only by this entry
+}
+
+// checker walks a volume and records everything it finds wrong.
+type checker struct {
+	v     *fatVolume
+	size  int64 // size of the image or device, 0 if unknown
+	rep   checkReport
+	owner map[uint32]string
+	lost  [][]uint32 // lost chains, head first
+	fixes []chainFix
+}
+
+func (c *checker) add(sev, code, path string, cluster uint32, format string, a ...interface{}) {
+	c.rep.Issues = append(c.rep.Issues, checkIssue{
+		Code: code, Severity: sev, Path: path, Cluster: cluster, Message: fmt.Sprintf(format, a...),
+	})
+	switch sev {
+	case sevError:
+		c.rep.Errors++
+	case sevWarning:
+		c.rep.Warnings++
+	}
+}
+
+// runCheck checks v and returns the checker holding the report.
+func runCheck(v *fatVolume, size int64, target string) *checker {
+	c := &checker{v: v, size: size, owner: map[uint32]string{}}
+	c.rep.Target = target
+	c.rep.FATType = int(v.ft)
+	c.rep.ClusterBytes = v.clusterBytes()
+	c.rep.Clusters = v.clusters
+	c.rep.Issues = []checkIssue{}
+	c.checkBoot()
+	c.checkFATCopies()
+	c.checkReserved()
+	c.walkDir(0, "::", 0, entryRef{Path: "::", IsDir: true})
+	c.checkClusters()
+	c.checkFSInfo()
+	return c
+}
+
+/* ===================== Boot region ===================== */
+
+func (c *checker) checkBoot() {
+	v := c.v
+	sec := make([]byte, 512)
+	if _, err := v.r.ReadAt(sec, 0); err != nil {
+		c.add(sevError, "boot-read", "", 0, "cannot read boot sector: %v", err)
+		return
+	}
+	if sec[510] != 0x55 || sec[511] != 0xAA {
+		c.add(sevWarning, "boot-signature", "", 0, "boot sector signature is %02X%02X, expected 55AA", sec[510], sec[511])
+	}
+	if v.g.Media != 0xF0 && v.g.Media < 0xF8 {
+		c.add(sevError, "media", "", 0, "invalid media descriptor 0x%02X", v.g.Media)
+	}
+	if byte(v.entry(0)) != v.g.Media {
+		c.add(sevWarning, "media", "", 0, "FAT[0] media byte 0x%02X does not match BPB media 0x%02X", byte(v.entry(0)), v.g.Media)
+	}
+	need := int64(v.totalSectors()) * v.bps()
+	if c.size > 0 && need > c.size {
+		c.add(sevError, "total-sectors", "", 0, "BPB declares %d sectors (%s) but the target holds only %s", v.totalSectors(), human(need), human(c.size))
+	}
+	if (uint32(v.g.RootEntries)*32)%uint32(v.g.BytesPerSector) != 0 {
+		c.add(sevWarning, "root-entries", "", 0, "root entry count %d does not fill whole sectors", v.g.RootEntries)
+	}
+
+	// Compare the FAT size with what computeLayout derives for this geometry.
+	g := v.g
+	if v.ft == FAT32 {
+		g.SectorsPerFAT32 = v.fatSecs
+	}
+	fatSecs, _, _, _, err := computeLayout(v.ft, &g)
+	switch {
+	case err != nil:
+		c.add(sevWarning, "layout", "", 0, "geometry does not satisfy FAT%d layout rules: %v", v.ft, err)
+	case fatSecs > v.fatSecs:
+		c.add(sevError, "fat-size", "", 0, "sectors/FAT is %d, layout needs %d", v.fatSecs, fatSecs)
+	case fatSecs < v.fatSecs:
+		c.add(sevInfo, "fat-size", "", 0, "sectors/FAT is %d, %d would do", v.fatSecs, fatSecs)
+	}
+
+	if v.ft != FAT32 {
+		return
+	}
+	if !v.validCluster(v.g.RootCluster) {
+		c.add(sevError, "root-cluster", "", 0, "root cluster %d is out of range", v.g.RootCluster)
+	}
+	if v.g.FSInfoSector == 0 || v.g.FSInfoSector >= v.g.ReservedSectors {
+		c.add(sevWarning, "fsinfo-sector", "", 0, "FSInfo sector %d is outside the reserved area", v.g.FSInfoSector)
+	}
+	if bb := v.g.BackupBootSector; bb != 0 && bb < v.g.ReservedSectors {
+		backup := make([]byte, 512)
+		if _, err := v.r.ReadAt(backup, int64(bb)*v.bps()); err == nil && !bytes.Equal(sec, backup) {
+			c.add(sevWarning, "backup-boot", "", 0, "backup boot sector %d differs from sector 0", bb)
+		}
+		if fb := bb + v.g.FSInfoSector; v.g.FSInfoSector != 0 && fb < v.g.ReservedSectors {
+			fs := make([]byte, 512)
+			if _, err := v.r.ReadAt(fs, int64(fb)*v.bps()); err == nil && !validFSInfo(fs) {
+				c.add(sevWarning, "backup-fsinfo", "", 0, "backup FSInfo sector %d has bad signatures", fb)
+			}
+		}
+	}
+}
+
+// checkFATCopies compares every FAT copy with FAT #1.
+func (c *checker) checkFATCopies() {
+	v := c.v
+	bps := v.bps()
+	buf := make([]byte, len(v.fat))
+	for i := 1; i < int(v.g.NumFATs); i++ {
+		if _, err := v.r.ReadAt(buf, v.fatStart(i)*bps); err != nil {
+			c.add(sevError, "fat-read", "", 0, "cannot read FAT #%d: %v", i+1, err)
+			continue
+		}
+		diff := 0
+		for s := int64(0); s < int64(v.fatSecs); s++ {
+			if !bytes.Equal(buf[s*bps:(s+1)*bps], v.fat[s*bps:(s+1)*bps]) {
+				diff++
+			}
+		}
+		if diff > 0 {
+			c.add(sevError, "fat-mismatch", "", 0, "FAT #%d differs from FAT #1 in %d sector(s)", i+1, diff)
+		}
+	}
+}
+
+// fatStatusBits returns the clean-shutdown and no-error bits of FAT[1].
+func (v *fatVolume) fatStatusBits() (clean, noErr uint32) {
+	if v.ft == FAT32 {
+		return 0x08000000, 0x04000000
+	}
+	return 0x8000, 0x4000
+}
+
+// checkReserved looks at the status bits kept in FAT[1] on FAT16/32.
+func (c *checker) checkReserved() {
+	v := c.v
+	if v.ft == FAT12 {
+		return
+	}
+	clean, noErr := v.fatStatusBits()
+	x := v.entry(1)
+	if x&clean == 0 {
+		c.add(sevWarning, "dirty", "", 0, "volume was not cleanly unmounted (FAT[1] clean bit clear)")
+	}
+	if x&noErr == 0 {
+		c.add(sevWarning, "io-errors", "", 0, "disk I/O errors were recorded (FAT[1] error bit clear)")
+	}
+}
+
+/* ===================== Directory tree ===================== */
+
+// shortNameInvalid lists bytes DOS does not allow in short names.
+const shortNameInvalid = "\"*+,./:;<=>?[\\]|"
+
+func badShortName(s [11]byte) bool {
+	if s[0] == ' ' {
+		return true
+	}
+	for _, b := range s {
+		if b < 0x20 && b != 0x05 || strings.IndexByte(shortNameInvalid, b) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// claim marks chain as used by path and reports cross-links. It returns
+// the index of the first cross-linked cluster, or -1.
+func (c *checker) claim(path string, chain []uint32) int {
+	first := -1
+	for i, cl := range chain {
+		if other, dup := c.owner[cl]; dup {
+			c.add(sevError, "cross-link", path, cl, "cross-linked with %s", other)
+			if first < 0 {
+				first = i
+			}
+			continue
+		}
+		c.owner[cl] = path
+	}
+	return first
+}
+
+// addFix records a truncation of ref's chain to keep clusters.
+func (c *checker) addFix(ref entryRef, kind string, chain []uint32, keep int) {
+	f := chainFix{entryRef: ref, Kind: kind, Chain: chain, Keep: keep}
+	if kind != "cross-link" {
+		for _, cl := range chain[keep:] {
+			if c.owner[cl] == ref.Path {
+				f.Free = append(f.Free, cl)
+			}
+		}
+	}
+	c.fixes = append(c.fixes, f)
+}
+
+func (c *checker) walkDir(cluster uint32, path string, parent uint32, ref entryRef) {
+	v := c.v
+	root := path == "::"
+	first := cluster
+	if root && v.ft == FAT32 {
+		first = v.g.RootCluster
+	}
+	if first != 0 {
+		chain, err := v.chain(first)
+		if err != nil {
+			c.add(sevError, "broken-chain", path+"/", first, "directory %v", err)
+			if !root {
+				c.addFix(ref, "size", chain, len(chain))
+			}
+		}
+		owner := path
+		if root {
+			owner = "::/"
+		}
+		if i := c.claim(owner, chain); i >= 0 {
+			if !root {
+				c.addFix(ref, "cross-link", chain, i)
+			}
+			return
+		}
+	}
+	d, err := v.readDir(cluster)
+	if err != nil {
+		c.add(sevError, "bad-directory", path+"/", cluster, "%v", err)
+		return
+	}
+	entries := d.entries()
+	if !root {
+		if len(entries) < 2 || string(entries[0].Short[:]) != ".          " || string(entries[1].Short[:]) != "..         " {
+			c.add(sevError, "dot-entry", path, cluster, "missing \".\" or \"..\" entry")
+		} else {
+			if entries[0].Cluster != cluster {
+				c.add(sevError, "dot-entry", path, cluster, "\".\" points to cluster %d", entries[0].Cluster)
+			}
+			if entries[1].Cluster != parent {
+				c.add(sevError, "dot-entry", path, cluster, "\"..\" points to cluster %d, parent is %d", entries[1].Cluster, parent)
+			}
+		}
+	}
+	for _, e := range entries {
+		p := path + "/" + e.Name
+		if e.isLabel() {
+			if !root {
+				c.add(sevWarning, "label-entry", p, 0, "volume label entry outside the root directory")
+			}
+			continue
+		}
+		if e.isDotDir() {
+			continue
+		}
+		if badShortName(e.Short) {
+			c.add(sevError, "bad-name", p, 0, "invalid short name %q", string(e.Short[:]))
+		}
+		if e.Attr&0xC0 != 0 {
+			c.add(sevWarning, "bad-attr", p, 0, "reserved attribute bits set (0x%02X)", e.Attr)
+		}
+		if e.Cluster != 0 && !v.validCluster(e.Cluster) {
+			c.add(sevError, "bad-cluster", p, e.Cluster, "start cluster out of range")
+			continue
+		}
+		ref := entryRef{Dir: cluster, Slot: e.Slot, LFNSlot: e.LFNSlot, Path: p, IsDir: e.isDir(), Size: e.Size}
+		if e.isDir() {
+			c.rep.Dirs++
+			if e.Cluster == 0 {
+				c.add(sevError, "bad-cluster", p, 0, "directory has no clusters")
+				continue
+			}
+			c.walkDir(e.Cluster, p, cluster, ref)
+			continue
+		}
+		c.rep.Files++
+		c.rep.FileBytes += int64(e.Size)
+		c.checkFile(e, ref)
+	}
+}
+
+func (c *checker) checkFile(e dirEntry, ref entryRef) {
+	v := c.v
+	p := ref.Path
+	if e.Cluster == 0 {
+		if e.Size != 0 {
+			c.add(sevError, "size-mismatch", p, 0, "size is %d but no clusters are allocated", e.Size)
+			c.addFix(ref, "size", nil, 0)
+		}
+		return
+	}
+	chain, err := v.chain(e.Cluster)
+	if err != nil {
+		c.add(sevError, "broken-chain", p, e.Cluster, "%v", err)
+	}
+	if i := c.claim(p, chain); i >= 0 {
+		c.addFix(ref, "cross-link", chain, i)
+		return
+	}
+	need := v.clustersFor(int64(e.Size))
+	switch {
+	case err != nil:
+		c.addFix(ref, "size", chain, min(need, len(chain)))
+	case need != len(chain):
+		c.add(sevError, "size-mismatch", p, e.Cluster, "size %d needs %d cluster(s), chain has %d", e.Size, need, len(chain))
+		c.addFix(ref, "size", chain, min(need, len(chain)))
+	}
+}
+
+/* ===================== Cluster accounting ===================== */
+
+// checkClusters counts free, bad and lost clusters and groups lost ones into chains.
+func (c *checker) checkClusters() {
+	v := c.v
+	lost := map[uint32]bool{}
+	for cl := uint32(2); cl < v.clusters+2; cl++ {
+		x := v.entry(cl)
+		switch {
+		case x == 0:
+			c.rep.FreeClusters++
+		case v.isBad(x):
+			c.rep.BadClusters++
+		case c.owner[cl] == "":
+			lost[cl] = true
+		}
+	}
+	if len(lost) == 0 {
+		return
+	}
+	pointed := map[uint32]bool{}
+	for cl := range lost {
+		if next := v.entry(cl); lost[next] {
+			pointed[next] = true
+		}
+	}
+	for cl := uint32(2); cl < v.clusters+2; cl++ {
+		if !lost[cl] || pointed[cl] {
+			continue
+		}
+		chain := []uint32{}
+		for x := cl; lost[x]; x = v.entry(x) {
+			chain = append(chain, x)
+			delete(lost, x)
+		}
+		c.lost = append(c.lost, chain)
+		c.rep.LostClusters += uint32(len(chain))
+	}
+	// Whatever is left forms loops with no head; treat each as its own chain.
+	for cl := uint32(2); cl < v.clusters+2 && len(lost) > 0; cl++ {
+		if !lost[cl] {
+			continue
+		}
+		chain := []uint32{}
+		for x := cl; lost[x]; x = v.entry(x) {
+			chain = append(chain, x)
+			delete(lost, x)
+		}
+		c.lost = append(c.lost, chain)
+		c.rep.LostClusters += uint32(len(chain))
+	}
+	c.add(sevError, "lost-clusters", "", 0, "%d lost cluster(s) in %d chain(s)", c.rep.LostClusters, len(c.lost))
+}
+
+// checkFSInfo compares the FAT32 FSInfo counters with the FAT.
+func (c *checker) checkFSInfo() {
+	v := c.v
+	if v.ft != FAT32 || v.g.FSInfoSector == 0 || v.g.FSInfoSector >= v.g.ReservedSectors {
+		return
+	}
+	fs := make([]byte, 512)
+	if _, err := v.r.ReadAt(fs, int64(v.g.FSInfoSector)*v.bps()); err != nil {
+		c.add(sevError, "fsinfo-read", "", 0, "cannot read FSInfo: %v", err)
+		return
+	}
+	if !validFSInfo(fs) {
+		c.add(sevError, "fsinfo-signature", "", 0, "FSInfo sector %d has bad signatures", v.g.FSInfoSector)
+		return
+	}
+	free := binary.LittleEndian.Uint32(fs[488:])
+	switch {
+	case free == 0xFFFFFFFF:
+		c.add(sevInfo, "fsinfo-free", "", 0, "FSInfo free count is unknown")
+	case free != c.rep.FreeClusters:
+		c.add(sevWarning, "fsinfo-free", "", 0, "FSInfo free count is %d, FAT has %d free", free, c.rep.FreeClusters)
+	}
+	if next := binary.LittleEndian.Uint32(fs[492:]); next != 0xFFFFFFFF && !v.validCluster(next) {
+		c.add(sevWarning, "fsinfo-next", "", 0, "FSInfo next-free hint %d is out of range", next)
+	}
+}
+
+/* ===================== Output ===================== */
+
+func printCheckReport(r checkReport) {
+	fmt.Printf("Checking %s (FAT%d, %d clusters of %d bytes)\n", r.Target, r.FATType, r.Clusters, r.ClusterBytes)
+	for _, is := range r.Issues {
+		where := is.Path
+		if is.Cluster != 0 {
+			where = strings.TrimSpace(fmt.Sprintf("%s (cluster %d)", where, is.Cluster))
+		}
+		if where != "" {
+			where += ": "
+		}
+		fmt.Printf("  %-7s %-16s %s%s\n", strings.ToUpper(is.Severity), is.Code, where, is.Message)
+	}
+	cb := r.ClusterBytes
+	used := int64(r.Clusters-r.FreeClusters-r.BadClusters-r.LostClusters) * cb
+	fmt.Println()
+	fmt.Printf("%14d bytes total disk space\n", int64(r.Clusters)*cb)
+	fmt.Printf("%14d bytes in %d directories and %d user files\n", used, r.Dirs, r.Files)
+	if r.BadClusters > 0 {
+		fmt.Printf("%14d bytes in bad sectors\n", int64(r.BadClusters)*cb)
+	}
+	if r.LostClusters > 0 {
+		fmt.Printf("%14d bytes in lost clusters\n", int64(r.LostClusters)*cb)
+	}
+	fmt.Printf("%14d bytes available on disk\n", int64(r.FreeClusters)*cb)
+	fmt.Printf("\n%d error(s), %d warning(s)\n", r.Errors, r.Warnings)
+}
+
+func newCheckCmd() *cobra.Command {
+	var output string
+	var repair, dryRun bool
+	var fatSource int
+	guard := newDeviceGuard()
+	cmd := &cobra.Command{
+		Use:   "check <image|device>",
+		Short: "Check a FAT12/16/32 image or device for consistency",
+		Long: "Check a FAT12/16/32 image or device for consistency. The check is read-only\n" +
+			"unless --repair is given; --dry-run shows the repair as a sector-level plan\n" +
+			"without writing anything.\n\n" +
+			"Exit status: 0 no errors, 1 errors repaired, 4 errors left, 2 the check could not run.",
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(_ *cobra.Command, args []string) error {
+			if err := checkOutputFormat(output); err != nil {
+				return err
+			}
+			if dryRun {
+				repair = true
+			}
+			f, v, err := openVolumeFile(args[0], repair && !dryRun, guard)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			size, _ := getDeviceSize(f)
+			c := runCheck(v, size, args[0])
+			if output == "text" {
+				printCheckReport(c.rep)
+			}
+
+			rep := c.rep
+			code := checkExitClean
+			if rep.Errors > 0 {
+				code = checkExitErrors
+			}
+			if repair {
+				ov := newSectorOverlay(f, v.bps())
+				rv, err := openFATVolume(ov, ov)
+				if err != nil {
+					return err
+				}
+				actions, err := repairVolume(rv, size, args[0], repairOptions{fatSource: fatSource})
+				if err != nil {
+					return fmt.Errorf("repair: %w", err)
+				}
+				changes, err := ov.changes()
+				if err != nil {
+					return err
+				}
+				after := runCheck(rv, size, args[0])
+				rr := &repairReport{DryRun: dryRun, Actions: actions, Sectors: []plannedSector{}, RemainingErrors: after.rep.Errors}
+				for _, ch := range changes {
+					n := 0
+					for i := range ch.Old {
+						if ch.Old[i] != ch.New[i] {
+							n++
+						}
+					}
+					rr.Sectors = append(rr.Sectors, plannedSector{Sector: ch.Sector, Role: rv.sectorRole(ch.Sector), Bytes: n})
+				}
+				rep.Repair = rr
+
+				if output == "text" {
+					fmt.Println("\nRepair plan:")
+					if len(actions) == 0 {
+						fmt.Println("  nothing to do")
+					}
+					for _, a := range actions {
+						fmt.Printf("  - %s\n", a)
+					}
+					if len(changes) > 0 {
+						fmt.Println()
+						printSectorPlan(rv, changes)
+					}
+				}
+				if !dryRun && len(changes) > 0 {
+					audit := newVolumeAudit("check", args[0])
+					_, err := ov.commit(f)
+					if err == nil {
+						err = f.Sync()
+					}
+					audit.finish(err)
+					if err != nil {
+						return err
+					}
+				}
+				if output == "text" {
+					verb := "written"
+					if dryRun {
+						verb = "would be written"
+					}
+					fmt.Printf("\n%d sector(s) %s, %d error(s) left after repair\n", len(changes), verb, after.rep.Errors)
+				}
+				if !dryRun {
+					switch {
+					case after.rep.Errors > 0:
+						code = checkExitErrors
+					case len(changes) > 0 && rep.Errors > 0:
+						code = checkExitCorrected
+					default:
+						code = checkExitClean
+					}
+				}
+			}
+
+			if output != "text" {
+				if err := writeStructured(os.Stdout, rep, output); err != nil {
+					return err
+				}
+			}
+			if code != checkExitClean {
+				return &exitCodeError{code: code}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&output, "output", "text", "report format: text|json|yaml")
+	cmd.Flags().BoolVar(&repair, "repair", false, "repair the errors found (writes to the target)")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "print the repair plan without writing (implies --repair)")
+	cmd.Flags().IntVar(&fatSource, "fat-source", 1, "FAT copy treated as authoritative when the copies differ")
+	guard.addInUseFlags(cmd)
+	return cmd
+}
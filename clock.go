@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ===================== Clock and volume serials ===================== */
+
+// buildTime is the fixed time of a reproducible build; zero means use the
+// real clock. Every timestamp written to a volume goes through now or
+// stampTime, so setting it makes images bit-identical across runs.
+var buildTime time.Time
+
+// buildSerial is the volume serial of a reproducible build.
+var buildSerial uint32
+
+// dosEpoch is the earliest time a FAT directory entry can hold.
+var dosEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// reproducible reports whether timestamps and serials are fixed.
+func reproducible() bool { return !buildTime.IsZero() }
+
+// now returns the time to stamp new entries with.
+func now() time.Time {
+	if reproducible() {
+		return buildTime
+	}
+	return time.Now()
+}
+
+// stampTime returns t, or the build time in reproducible mode. It is used
+// for times taken from host files.
+func stampTime(t time.Time) time.Time {
+	if reproducible() {
+		return buildTime
+	}
+	return t
+}
+
+// setupReproducible enables reproducible mode from SOURCE_DATE_EPOCH and/or
+// a seed. The epoch fixes the timestamps (the DOS epoch is used when only a
+// seed is given); the seed, or else the epoch, fixes the serial.
+func setupReproducible(seed string) error {
+	env := os.Getenv("SOURCE_DATE_EPOCH")
+	if env == "" && seed == "" {
+		return nil
+	}
+	t := dosEpoch
+	if env != "" {
+		secs, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return fmt.Errorf("SOURCE_DATE_EPOCH %q: %w", env, err)
+		}
+		t = time.Unix(secs, 0).UTC()
+		if t.Before(dosEpoch) {
+			t = dosEpoch
+		}
+	}
+	buildTime = t
+	buildSerial = serialFromTime(t)
+	if seed != "" {
+		h := fnv.New32a()
+		h.Write([]byte(seed))
+		buildSerial = h.Sum32()
+	}
+	return nil
+}
+
+// serialFromTime derives a volume serial from a time the way DOS FORMAT
+// does: date and time words, each pair added together.
+func serialFromTime(t time.Time) uint32 {
+	lo := uint16(t.Month())<<8 | uint16(t.Day())
+	lo += uint16(t.Second())<<8 | uint16(t.Nanosecond()/10_000_000)
+	hi := uint16(t.Hour())<<8 | uint16(t.Minute())
+	hi += uint16(t.Year())
+	return uint32(hi)<<16 | uint32(lo)
+}
+
+// newSerial returns the serial for a volume being formatted now.
+func newSerial() uint32 {
+	if reproducible() {
+		return buildSerial
+	}
+	return serialFromTime(time.Now())
+}
+
+// parseSerial accepts "1234-ABCD", "0x1234ABCD" or "1234ABCD".
+func parseSerial(s string) (uint32, error) {
+	h := strings.TrimPrefix(strings.TrimPrefix(strings.ReplaceAll(s, "-", ""), "0x"), "0X")
+	if len(h) == 0 || len(h) > 8 {
+		return 0, fmt.Errorf("invalid serial %q (want e.g. 1234-ABCD)", s)
+	}
+	n, err := strconv.ParseUint(h, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid serial %q (want e.g. 1234-ABCD)", s)
+	}
+	return uint32(n), nil
+}
@@ -0,0 +1,94 @@
+// confirm.go
+// Typed confirmation before destructive writes: show what the target is and
+// make the operator type its name or serial back.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// deviceIdentity is what the operator is shown before a device is written.
+type deviceIdentity struct {
+	Path     string
+	Name     string // kernel name, e.g. sdb
+	Model    string
+	Vendor   string
+	Serial   string
+	Size     int64
+	Contents fsSignature
+}
+
+// identify collects the identity of device from sysfs (under g.SysfsRoot)
+// and from its first sectors. A partition gets the model, vendor and serial
+// of its disk. Fields that cannot be found are left empty.
+func (g *deviceGuard) identify(device string) deviceIdentity {
+	path := device
+	if p, err := filepath.EvalSymlinks(device); err == nil {
+		path = p
+	}
+	id := deviceIdentity{Path: device, Name: filepath.Base(path)}
+	if b, err := readSysfsBlock(g.SysfsRoot, id.Name); err == nil {
+		id.Model, id.Vendor, id.Serial, id.Size = b.Model, b.Vendor, b.Serial, b.Size
+	}
+	if id.Size == 0 {
+		id.Size = g.size(filepath.Join(g.SysfsRoot, "class", "block", id.Name), device)
+	}
+	if sig, err := detectFilesystemPath(device); err == nil {
+		id.Contents = sig
+	}
+	return id
+}
+
+// confirmDevice shows id and reads a line from in, which must be the device
+// name or its serial. action says what is about to happen ("format",
+// "overwrite"). Without a terminal to ask on it fails, pointing at --yes.
+func confirmDevice(id deviceIdentity, action string, in io.Reader, out io.Writer) error {
+	if f, ok := in.(*os.File); ok && !isTerminal(f) {
+		return fmt.Errorf("refusing to %s %s without confirmation: stdin is not a terminal (use --yes)", action, id.Path)
+	}
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	size := "-"
+	if id.Size > 0 {
+		size = fmt.Sprintf("%s (%d bytes)", human(id.Size), id.Size)
+	}
+	contents := "-"
+	if id.Contents.Type != "" {
+		contents = id.Contents.String()
+	}
+	fmt.Fprintf(out, "About to %s %s. Everything on it will be lost.\n\n", action, id.Path)
+	fmt.Fprintf(out, "  Model:    %s\n", orDash(id.Model))
+	fmt.Fprintf(out, "  Vendor:   %s\n", orDash(id.Vendor))
+	fmt.Fprintf(out, "  Serial:   %s\n", orDash(id.Serial))
+	fmt.Fprintf(out, "  Size:     %s\n", size)
+	fmt.Fprintf(out, "  Contents: %s\n\n", contents)
+	if id.Serial != "" {
+		fmt.Fprintf(out, "Type the device name (%s) or its serial to continue: ", id.Name)
+	} else {
+		fmt.Fprintf(out, "Type the device name (%s) to continue: ", id.Name)
+	}
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	answer := strings.TrimSpace(line)
+	switch {
+	case answer == "":
+	case answer == id.Name, answer == id.Path, answer == "/dev/"+id.Name:
+		return nil
+	case id.Serial != "" && answer == id.Serial:
+		return nil
+	}
+	return fmt.Errorf("confirmation %q does not match %s; nothing was written", answer, id.Name)
+}
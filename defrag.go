@@ -0,0 +1,542 @@
+// defrag.go
+// Defragmenter: makes every file contiguous and moves directories to the
+// front of the data area, animating the moves on the retrodfrg map.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"mkfat/retrodfrg"
+)
+
+// Per-cluster states shown on the defrag map.
+const (
+	dfFree byte = iota
+	dfPlaced
+	dfUsed
+	dfBad
+	dfRead
+	dfWrite
+)
+
+// dfGlyphs maps cluster states to map glyphs. When one cell covers several
+// clusters the highest state wins, so activity is never hidden.
+var dfGlyphs = [...]rune{dfFree: '░', dfPlaced: '█', dfUsed: '▓', dfBad: 'B', dfRead: 'r', dfWrite: 'W'}
+
+// defragItem is a file or directory whose clusters the defragmenter moves.
+type defragItem struct {
+	ref   entryRef // short entry pointing at the chain
+	root  bool     // FAT32 root directory, located through the BPB instead
+	chain []uint32
+}
+
+// defragger moves items one at a time. Each move copies the data, links the
+// new chain, switches the entry and only then frees the old chain, syncing
+// in between, so an interrupted run leaves at worst a lost copy behind.
+type defragger struct {
+	v     *fatVolume
+	f     *os.File
+	items []*defragItem
+	owner map[uint32]*defragItem
+	state []byte // indexed by cluster number
+
+	ui       *retrodfrg.UI
+	stop     chan struct{}
+	start    time.Time
+	lastDraw time.Time
+	op       string
+	done     int // items handled so far
+
+	moves, movedClusters, skipped int
+}
+
+func newDefragger(v *fatVolume, f *os.File) (*defragger, error) {
+	d := &defragger{
+		v:     v,
+		f:     f,
+		owner: map[uint32]*defragItem{},
+		state: make([]byte, v.clusters+2),
+		stop:  make(chan struct{}),
+		start: time.Now(),
+	}
+	var dirs, files []*defragItem
+	if v.ft == FAT32 {
+		chain, err := v.chain(v.g.RootCluster)
+		if err != nil {
+			return nil, fmt.Errorf("root directory: %w", err)
+		}
+		dirs = append(dirs, &defragItem{ref: entryRef{Path: "::", IsDir: true}, root: true, chain: chain})
+	}
+	var walk func(cluster uint32, path string) error
+	walk = func(cluster uint32, path string) error {
+		dir, err := v.readDir(cluster)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, e := range dir.entries() {
+			if e.isLabel() || e.isDotDir() || e.Cluster == 0 {
+				continue
+			}
+			p := path + "/" + e.Name
+			chain, err := v.chain(e.Cluster)
+			if err != nil {
+				return fmt.Errorf("%s: %w", p, err)
+			}
+			it := &defragItem{
+				ref:   entryRef{Dir: cluster, Slot: e.Slot, LFNSlot: e.LFNSlot, Path: p, IsDir: e.isDir(), Size: e.Size},
+				chain: chain,
+			}
+			if !e.isDir() {
+				files = append(files, it)
+				continue
+			}
+			dirs = append(dirs, it)
+			if err := walk(e.Cluster, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(0, "::"); err != nil {
+		return nil, err
+	}
+	d.items = append(dirs, files...)
+
+	for c := uint32(2); c < v.clusters+2; c++ {
+		switch x := v.entry(c); {
+		case x == 0:
+			d.state[c] = dfFree
+		case v.isBad(x):
+			d.state[c] = dfBad
+		default:
+			d.state[c] = dfUsed
+		}
+	}
+	for _, it := range d.items {
+		for _, c := range it.chain {
+			d.owner[c] = it
+		}
+	}
+	return d, nil
+}
+
+// fragmented counts the items whose chain is not contiguous.
+func (d *defragger) fragmented() int {
+	n := 0
+	for _, it := range d.items {
+		for i := 1; i < len(it.chain); i++ {
+			if it.chain[i] != it.chain[i-1]+1 {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+func (d *defragger) stopped() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return d.ui != nil && d.ui.IsStopped()
+	}
+}
+
+// run places every item, in order, right after the previous one.
+func (d *defragger) run() error {
+	next := uint32(2)
+	for _, it := range d.items {
+		if d.stopped() {
+			return retrodfrg.ErrInterrupted
+		}
+		d.op = "Checking " + it.ref.Path
+		d.draw(true)
+		n := uint32(len(it.chain))
+		p, ok := d.target(next, n)
+		if !ok {
+			d.skipped++
+			d.done++
+			continue
+		}
+		if !d.contiguousAt(it, p) {
+			err := d.clear(p, n, it)
+			if err == nil {
+				d.op = "Moving " + it.ref.Path
+				err = d.move(it, clusterRange(p, n))
+			}
+			if errors.Is(err, errNoSpace) {
+				d.skipped++
+				d.done++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, c := range it.chain {
+			d.state[c] = dfPlaced
+		}
+		next = p + n
+		d.done++
+	}
+	d.op = "Done"
+	d.draw(true)
+	return nil
+}
+
+// target returns the first cluster at or after next that starts n clusters
+// free of bad ones.
+func (d *defragger) target(next, n uint32) (uint32, bool) {
+	end := d.v.clusters + 2
+	for p := next; p+n <= end; p++ {
+		ok := true
+		for c := p; c < p+n; c++ {
+			if d.state[c] == dfBad {
+				p, ok = c, false
+				break
+			}
+		}
+		if ok {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
+func (d *defragger) contiguousAt(it *defragItem, p uint32) bool {
+	for i, c := range it.chain {
+		if c != p+uint32(i) {
+			return false
+		}
+	}
+	return true
+}
+
+func clusterRange(p, n uint32) []uint32 {
+	out := make([]uint32, n)
+	for i := range out {
+		out[i] = p + uint32(i)
+	}
+	return out
+}
+
+// clear moves every item with clusters in [p, p+n) out of the way, it included.
+func (d *defragger) clear(p, n uint32, it *defragItem) error {
+	for c := p; c < p+n; c++ {
+		o := d.owner[c]
+		if o == nil || o == it {
+			continue
+		}
+		dst, err := d.pickFree(len(o.chain), p, p+n)
+		if err != nil {
+			return err
+		}
+		d.op = "Making room: " + o.ref.Path
+		if err := d.move(o, dst); err != nil {
+			return err
+		}
+	}
+	for _, c := range it.chain {
+		if c >= p && c < p+n {
+			dst, err := d.pickFree(len(it.chain), p, p+n)
+			if err != nil {
+				return err
+			}
+			d.op = "Making room: " + it.ref.Path
+			return d.move(it, dst)
+		}
+	}
+	return nil
+}
+
+// pickFree finds n free clusters outside [lo, hi), preferring one
+// contiguous run after hi, then any free clusters after hi, then any at all.
+func (d *defragger) pickFree(n int, lo, hi uint32) ([]uint32, error) {
+	v := d.v
+	end := v.clusters + 2
+	run := uint32(0)
+	for c := hi; c < end; c++ {
+		if v.entry(c) != 0 {
+			run = 0
+			continue
+		}
+		if run++; run == uint32(n) {
+			return clusterRange(c-run+1, run), nil
+		}
+	}
+	out := []uint32{}
+	for _, from := range [][2]uint32{{hi, end}, {2, lo}} {
+		for c := from[0]; c < from[1] && len(out) < n; c++ {
+			if v.entry(c) == 0 {
+				out = append(out, c)
+			}
+		}
+	}
+	if len(out) < n {
+		return nil, errNoSpace
+	}
+	return out, nil
+}
+
+// move copies it onto the free clusters dst and switches its entry over.
+func (d *defragger) move(it *defragItem, dst []uint32) error {
+	v := d.v
+	cb := v.clusterBytes()
+	buf := make([]byte, cb)
+
+	// 1. Copy the data; the "." entry of a directory follows it.
+	for i, src := range it.chain {
+		if d.stopped() && i == 0 {
+			return retrodfrg.ErrInterrupted
+		}
+		d.state[src], d.state[dst[i]] = dfRead, dfWrite
+		d.draw(false)
+		if _, err := v.r.ReadAt(buf, v.clusterSector(src)*v.bps()); err != nil {
+			return fmt.Errorf("read cluster %d: %w", src, err)
+		}
+		if i == 0 && it.ref.IsDir && !it.root {
+			setEntryCluster(buf[0:32], dst[0])
+		}
+		if _, err := v.w.WriteAt(buf, v.clusterSector(dst[i])*v.bps()); err != nil {
+			return fmt.Errorf("write cluster %d: %w", dst[i], err)
+		}
+	}
+	if err := d.f.Sync(); err != nil {
+		return err
+	}
+
+	// 2. Link the new chain. Until the entry switches it is just lost.
+	for i, c := range dst {
+		if i+1 < len(dst) {
+			v.setEntry(c, dst[i+1])
+		} else {
+			v.setEntry(c, v.eocMark())
+		}
+	}
+	if err := d.commitFAT(); err != nil {
+		return err
+	}
+
+	// 3. Point the entry at the copy.
+	old := it.chain[0]
+	if err := d.switchEntry(it, dst[0]); err != nil {
+		return err
+	}
+	if it.ref.IsDir {
+		if err := d.relink(it, old, dst[0]); err != nil {
+			return err
+		}
+	}
+	if err := d.f.Sync(); err != nil {
+		return err
+	}
+
+	// 4. Release the old chain.
+	for _, c := range it.chain {
+		v.setEntry(c, 0)
+		delete(d.owner, c)
+		d.state[c] = dfFree
+	}
+	if err := d.commitFAT(); err != nil {
+		return err
+	}
+	for _, c := range dst {
+		d.owner[c] = it
+		d.state[c] = dfUsed
+	}
+	it.chain = dst
+	d.moves++
+	d.movedClusters += len(dst)
+	d.draw(true)
+	return nil
+}
+
+func (d *defragger) commitFAT() error {
+	if err := d.v.flush(); err != nil {
+		return err
+	}
+	return d.f.Sync()
+}
+
+// setEntryCluster stores the first cluster of a raw 32-byte entry.
+func setEntryCluster(raw []byte, c uint32) {
+	binary.LittleEndian.PutUint16(raw[20:], uint16(c>>16))
+	binary.LittleEndian.PutUint16(raw[26:], uint16(c))
+}
+
+// switchEntry points the entry of it, or the BPB for the FAT32 root, at first.
+func (d *defragger) switchEntry(it *defragItem, first uint32) error {
+	v := d.v
+	if it.root {
+		secs := []int64{0}
+		if v.g.BackupBootSector != 0 && v.g.BackupBootSector < v.g.ReservedSectors {
+			secs = append(secs, int64(v.g.BackupBootSector))
+		}
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, first)
+		for _, s := range secs {
+			if _, err := v.w.WriteAt(b, s*v.bps()+44); err != nil {
+				return fmt.Errorf("write boot sector %d: %w", s, err)
+			}
+		}
+		v.g.RootCluster = first
+		return nil
+	}
+	dir, err := v.readDir(it.ref.Dir)
+	if err != nil {
+		return err
+	}
+	raw := append([]byte(nil), dir.data[it.ref.Slot*32:it.ref.Slot*32+32]...)
+	setEntryCluster(raw, first)
+	return v.writeSlots(dir, it.ref.Slot, raw)
+}
+
+// relink updates what refers to a moved directory: the recorded location of
+// its children's entries and the ".." entries of its subdirectories.
+func (d *defragger) relink(it *defragItem, old, first uint32) error {
+	if it.root {
+		return nil // children keep Dir 0 and ".." 0
+	}
+	v := d.v
+	for _, o := range d.items {
+		if o.root || o.ref.Dir != old {
+			continue
+		}
+		o.ref.Dir = first
+		if !o.ref.IsDir {
+			continue
+		}
+		off := v.clusterSector(o.chain[0])*v.bps() + 32
+		raw := make([]byte, 32)
+		if _, err := v.r.ReadAt(raw, off); err != nil {
+			return err
+		}
+		setEntryCluster(raw, first)
+		if _, err := v.w.WriteAt(raw, off); err != nil {
+			return fmt.Errorf("write \"..\" of %s: %w", o.ref.Path, err)
+		}
+	}
+	return nil
+}
+
+/* ===================== Display ===================== */
+
+func (d *defragger) draw(force bool) {
+	if d.ui == nil || (!force && time.Since(d.lastDraw) < 40*time.Millisecond) {
+		return
+	}
+	d.lastDraw = time.Now()
+	w, h := d.ui.Size()
+	rows := h - 11 // title, summary, legend, phase and status blocks
+	if w <= 0 || rows < 1 {
+		return
+	}
+	cells := int64(w) * int64(rows)
+	per := (int64(d.v.clusters) + cells - 1) / cells
+	if per < 1 {
+		per = 1
+	}
+	lines := []string{}
+	var b strings.Builder
+	for c := int64(2); c < int64(d.v.clusters)+2; c += per {
+		st := dfFree
+		for k := c; k < c+per && k < int64(d.v.clusters)+2; k++ {
+			st = max(st, d.state[k])
+		}
+		b.WriteRune(dfGlyphs[st])
+		if (c-2)/per%int64(w) == int64(w)-1 {
+			lines = append(lines, b.String())
+			b.Reset()
+		}
+	}
+	if b.Len() > 0 {
+		lines = append(lines, b.String())
+	}
+	d.ui.SetProgressMap(lines)
+	d.ui.SetSummaryLines([]string{
+		fmt.Sprintf("FAT%d  %d clusters of %d bytes  Items: %d", d.v.ft, d.v.clusters, d.v.clusterBytes(), len(d.items)),
+		fmt.Sprintf("Each block is %d cluster(s)", per),
+	})
+	d.ui.SetStatusLines([]string{
+		fmt.Sprintf("Items: %d / %d   Moves: %d   Clusters moved: %d", d.done, len(d.items), d.moves, d.movedClusters),
+		fmt.Sprintf("Elapsed: %s", time.Since(d.start).Truncate(time.Second)),
+		"Current op: " + d.op,
+	})
+	d.ui.LayoutAndDraw()
+}
+
+func newDefragCmd() *cobra.Command {
+	guard := newDeviceGuard()
+	cmd := &cobra.Command{
+		Use:   "defrag <image|device>",
+		Short: "Make every file contiguous and move directories to the front",
+		Long: "Make every file on a FAT12/16/32 image or device contiguous and move the\n" +
+			"directories to the front of the data area. Each move copies the data first,\n" +
+			"then links the new chain, switches the directory entry and frees the old\n" +
+			"clusters last, so an interrupted run never leaves a file on half-moved data.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(_ *cobra.Command, args []string) error {
+			f, v, err := openVolumeFile(args[0], true, guard)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			size, _ := getDeviceSize(f)
+			if c := runCheck(v, size, args[0]); c.rep.Errors > 0 {
+				return fmt.Errorf("%s has %d error(s); run \"mkfat check --repair\" first", args[0], c.rep.Errors)
+			}
+			d, err := newDefragger(v, f)
+			if err != nil {
+				return err
+			}
+			before := d.fragmented()
+
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sigChan)
+			go func() {
+				if _, ok := <-sigChan; ok {
+					close(d.stop)
+				}
+			}()
+
+			if ui, err := retrodfrg.NewUI(); err == nil {
+				d.ui = ui
+				ui.SetTitle(fmt.Sprintf("DEFRAG – %s  FAT%d", args[0], v.ft))
+				ui.SetLegend([]string{
+					"Legend:  █ in place   ▓ to be moved   ░ free   r reading   W writing   B bad | Q to stop",
+				})
+			}
+			audit := newVolumeAudit("defrag", args[0])
+			err = d.run()
+			if d.ui != nil {
+				d.ui.Close()
+			}
+			audit.finish(err)
+			if err != nil && !errors.Is(err, retrodfrg.ErrInterrupted) {
+				return err
+			}
+			if err != nil {
+				fmt.Println("Stopped; every finished move is complete and the volume is consistent.")
+			}
+			fmt.Printf("Moved %d item(s), %d cluster(s) in %s\n", d.moves, d.movedClusters, time.Since(d.start).Truncate(time.Millisecond))
+			fmt.Printf("Fragmented items: %d before, %d after\n", before, d.fragmented())
+			if d.skipped > 0 {
+				fmt.Printf("%d item(s) left in place: not enough free space to move them\n", d.skipped)
+			}
+			return nil
+		},
+	}
+	guard.addInUseFlags(cmd)
+	return cmd
+}
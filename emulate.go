@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+/* ===================== Drive emulation ===================== */
+
+// driveProfile describes the mechanics of a floppy drive for --emulate.
+type driveProfile struct {
+	Name       string
+	Desc       string
+	Capacity   int64 // formatted size the drive is picked for by "auto"
+	RPM        int
+	BitRate    int           // data rate, bits per second
+	Step       time.Duration // track-to-track step time
+	Settle     time.Duration // head settle time after stepping
+	HeadSwitch time.Duration
+}
+
+var driveProfiles = []driveProfile{
+	{"360k", `5.25" DD 360K`, 360 * 1024, 300, 250_000, 6 * time.Millisecond, 15 * time.Millisecond, time.Millisecond},
+	{"720k", `3.5" DD 720K`, 720 * 1024, 300, 250_000, 3 * time.Millisecond, 15 * time.Millisecond, time.Millisecond},
+	{"1.2m", `5.25" HD 1.2M`, 1200 * 1024, 360, 500_000, 3 * time.Millisecond, 15 * time.Millisecond, time.Millisecond},
+	{"1.44m", `3.5" HD 1.44M`, 1440 * 1024, 300, 500_000, 3 * time.Millisecond, 15 * time.Millisecond, time.Millisecond},
+	{"2.88m", `3.5" ED 2.88M`, 2880 * 1024, 300, 1_000_000, 3 * time.Millisecond, 15 * time.Millisecond, time.Millisecond},
+}
+
+// driveProfileFor resolves --drive. "auto" picks the drive for a standard
+// floppy size and returns nil, meaning no pacing, for any other size; "none"
+// never paces.
+func driveProfileFor(name string, size int64) (*driveProfile, error) {
+	name = strings.ToLower(name)
+	for i := range driveProfiles {
+		p := &driveProfiles[i]
+		if name == p.Name || (name == "auto" && size == p.Capacity) {
+			return p, nil
+		}
+	}
+	if name == "auto" || name == "none" {
+		return nil, nil
+	}
+	names := make([]string, len(driveProfiles))
+	for i, p := range driveProfiles {
+		names[i] = p.Name
+	}
+	return nil, fmt.Errorf("unknown --drive %q (want auto, none, %s)", name, strings.Join(names, ", "))
+}
+
+// mfmSectorOverhead is roughly what an MFM sector needs on the track besides
+// its 512 data bytes: sync, address marks, ID, CRCs and the minimal gaps.
+const mfmSectorOverhead = 62
+
+// pacedWriter passes writes on to w no faster than the emulated drive could
+// do them. It keeps a virtual drive clock: sectors pass under the head at a
+// fixed rate, so the disk angle is the clock modulo one rotation. Each
+// sector first waits for a seek (step and settle) or head switch, then for
+// the sector to come round, then for its transfer. A head switch at the end
+// of a track therefore costs nearly a full rotation, as on a real drive with
+// no track skew.
+type pacedWriter struct {
+	w     io.WriterAt
+	p     *driveProfile
+	spt   int64
+	heads int64
+
+	rotation   time.Duration
+	sectorTime time.Duration
+
+	start     time.Time
+	clock     time.Duration
+	cyl, head int64
+
+	seeks, headSwitches int
+}
+
+func newPacedWriter(w io.WriterAt, p *driveProfile, g geom) (*pacedWriter, error) {
+	spt, heads := int64(g.SectorsPerTrack), int64(g.NumHeads)
+	if spt <= 0 || heads <= 0 {
+		return nil, fmt.Errorf("cannot emulate a %s drive without sectors per track and heads", p.Desc)
+	}
+	rotation := time.Minute / time.Duration(p.RPM)
+	need := time.Duration(spt*(512+mfmSectorOverhead)*8) * time.Second / time.Duration(p.BitRate)
+	if need > rotation {
+		return nil, fmt.Errorf("%d sectors per track do not fit on a %s track", spt, p.Desc)
+	}
+	return &pacedWriter{
+		w:          w,
+		p:          p,
+		spt:        spt,
+		heads:      heads,
+		rotation:   rotation,
+		sectorTime: rotation / time.Duration(spt),
+	}, nil
+}
+
+// advance moves the drive clock past the transfer of sector lba.
+func (pw *pacedWriter) advance(lba int64) {
+	track := lba / pw.spt
+	cyl, head := track/pw.heads, track%pw.heads
+	switch {
+	case cyl != pw.cyl:
+		pw.clock += time.Duration(max(cyl-pw.cyl, pw.cyl-cyl))*pw.p.Step + pw.p.Settle
+		pw.seeks++
+	case head != pw.head:
+		pw.clock += pw.p.HeadSwitch
+		pw.headSwitches++
+	}
+	pw.cyl, pw.head = cyl, head
+	at := time.Duration(lba%pw.spt) * pw.sectorTime
+	pw.clock += (at - pw.clock%pw.rotation + pw.rotation) % pw.rotation
+	pw.clock += pw.sectorTime
+}
+
+func (pw *pacedWriter) WriteAt(b []byte, off int64) (int, error) {
+	if pw.start.IsZero() {
+		pw.start = time.Now()
+	}
+	for s := off / 512; s < (off+int64(len(b))+511)/512; s++ {
+		pw.advance(s)
+	}
+	if d := time.Until(pw.start.Add(pw.clock)); d > 0 {
+		time.Sleep(d)
+	}
+	return pw.w.WriteAt(b, off)
+}
+
+// trackBytes is the write size that keeps the display in step with the
+// drive: callers that write in large chunks use it instead.
+func (pw *pacedWriter) trackBytes() int64 { return pw.spt * 512 }
+
+// rate estimates the sustained bytes per second of writing sectors in
+// order from the start of the disk, seeks and head switches included.
+func (pw *pacedWriter) rate(sectors int64) float64 {
+	sim := *pw
+	sim.clock, sim.cyl, sim.head = 0, 0, 0
+	for s := int64(0); s < sectors; s++ {
+		sim.advance(s)
+	}
+	if sim.clock <= 0 {
+		return 0
+	}
+	return float64(sectors*512) / sim.clock.Seconds()
+}
+
+func (pw *pacedWriter) String() string {
+	return fmt.Sprintf("%s, %d rpm, %d kbit/s, step %s", pw.p.Desc, pw.p.RPM, pw.p.BitRate/1000, pw.p.Step)
+}
+
+// chunkFor returns the write size for w: a track on a paced writer, else def.
+func chunkFor(w io.WriterAt, def int64) int64 {
+	if t, ok := w.(interface{ trackBytes() int64 }); ok {
+		return min(t.trackBytes(), def)
+	}
+	return def
+}
@@ -0,0 +1,560 @@
+// fatfs.go
+// Read side of FAT12/16/32: BPB parsing, FAT chains and directory walking.
+// Works on any io.ReaderAt, so images and block devices behave the same.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+/* ===================== Volume ===================== */
+
+// fatVolume is a FAT filesystem opened on an image file or block device.
+// The geometry is decoded into the same geom struct the formatter fills in.
+type fatVolume struct {
+	r io.ReaderAt
+	w io.WriterAt // nil when opened read-only
+
+	ft     FATType
+	g      geom
+	oem    string
+	label  string
+	serial uint32
+
+	fatSecs, rootSecs, dataSecs, clusters uint32
+
+	fat      []byte         // FAT #1, cached in memory
+	dirty    map[int64]bool // FAT sectors (relative to the FAT start) changed since the last flush
+	nextFree uint32         // allocation hint
+}
+
+// Directory entry attributes
+const (
+	attrReadOnly = 0x01
+	attrHidden   = 0x02
+	attrSystem   = 0x04
+	attrVolumeID = 0x08
+	attrDir      = 0x10
+	attrArchive  = 0x20
+	attrLFN      = 0x0F
+)
+
+// parseBootSector decodes the BPB/EBPB of a FAT boot sector. The FAT type
+// is derived from the cluster count, as the Microsoft specification requires.
+func parseBootSector(sec []byte) (*fatVolume, error) {
+	if len(sec) < 512 {
+		return nil, fmt.Errorf("boot sector too short")
+	}
+	v := &fatVolume{}
+	g := &v.g
+	g.BytesPerSector = binary.LittleEndian.Uint16(sec[11:])
+	g.SectorsPerCluster = sec[13]
+	g.ReservedSectors = binary.LittleEndian.Uint16(sec[14:])
+	g.NumFATs = sec[16]
+	g.RootEntries = binary.LittleEndian.Uint16(sec[17:])
+	g.TotalSectors16 = binary.LittleEndian.Uint16(sec[19:])
+	g.Media = sec[21]
+	g.SectorsPerFAT16 = binary.LittleEndian.Uint16(sec[22:])
+	g.SectorsPerTrack = binary.LittleEndian.Uint16(sec[24:])
+	g.NumHeads = binary.LittleEndian.Uint16(sec[26:])
+	g.HiddenSectors = binary.LittleEndian.Uint32(sec[28:])
+	g.TotalSectors32 = binary.LittleEndian.Uint32(sec[32:])
+
+	switch g.BytesPerSector {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("not a FAT volume: bytes/sector=%d", g.BytesPerSector)
+	}
+	if g.SectorsPerCluster == 0 || g.SectorsPerCluster&(g.SectorsPerCluster-1) != 0 {
+		return nil, fmt.Errorf("not a FAT volume: sectors/cluster=%d", g.SectorsPerCluster)
+	}
+	if g.ReservedSectors == 0 || g.NumFATs == 0 {
+		return nil, fmt.Errorf("not a FAT volume: reserved=%d fats=%d", g.ReservedSectors, g.NumFATs)
+	}
+
+	v.fatSecs = uint32(g.SectorsPerFAT16)
+	if v.fatSecs == 0 {
+		g.SectorsPerFAT32 = binary.LittleEndian.Uint32(sec[36:])
+		g.RootCluster = binary.LittleEndian.Uint32(sec[44:])
+		g.FSInfoSector = binary.LittleEndian.Uint16(sec[48:])
+		g.BackupBootSector = binary.LittleEndian.Uint16(sec[50:])
+		v.fatSecs = g.SectorsPerFAT32
+	}
+	if v.fatSecs == 0 {
+		return nil, fmt.Errorf("not a FAT volume: sectors/FAT is zero")
+	}
+
+	bps := uint32(g.BytesPerSector)
+	v.rootSecs = (uint32(g.RootEntries)*32 + bps - 1) / bps
+	total := v.totalSectors()
+	meta := uint32(g.ReservedSectors) + uint32(g.NumFATs)*v.fatSecs + v.rootSecs
+	if total <= meta {
+		return nil, fmt.Errorf("not a FAT volume: total sectors %d leave no data area", total)
+	}
+	v.dataSecs = total - meta
+	v.clusters = v.dataSecs / uint32(g.SectorsPerCluster)
+	switch {
+	case v.clusters < 4085:
+		v.ft = FAT12
+	case v.clusters < 65525:
+		v.ft = FAT16
+	default:
+		v.ft = FAT32
+	}
+
+	// Extended BPB
+	ext := 36
+	if v.ft == FAT32 {
+		if g.SectorsPerFAT16 != 0 || g.RootEntries != 0 {
+			return nil, fmt.Errorf("FAT32 cluster count but FAT12/16 BPB fields set")
+		}
+		ext = 64
+	}
+	if sec[ext+2] == 0x29 {
+		v.serial = binary.LittleEndian.Uint32(sec[ext+3:])
+		v.label = strings.TrimRight(string(sec[ext+7:ext+18]), " ")
+	}
+	v.oem = strings.TrimRight(string(sec[3:11]), " \x00")
+
+	need := (v.clusters + 2) * 4
+	switch v.ft {
+	case FAT12:
+		need = ((v.clusters+2)*3 + 1) / 2
+	case FAT16:
+		need = (v.clusters + 2) * 2
+	}
+	if v.fatSecs*bps < need {
+		return nil, fmt.Errorf("FAT too small: %d sectors for %d clusters", v.fatSecs, v.clusters)
+	}
+	return v, nil
+}
+
+// openFATVolume reads the boot sector and FAT #1 from r. Pass a non-nil w
+// to allow modifications.
+func openFATVolume(r io.ReaderAt, w io.WriterAt) (*fatVolume, error) {
+	sec := make([]byte, 512)
+	if _, err := r.ReadAt(sec, 0); err != nil {
+		return nil, fmt.Errorf("read boot sector: %w", err)
+	}
+	v, err := parseBootSector(sec)
+	if err != nil {
+		return nil, err
+	}
+	v.r, v.w = r, w
+	v.fat = make([]byte, int64(v.fatSecs)*v.bps())
+	if _, err := r.ReadAt(v.fat, v.fatStart(0)*v.bps()); err != nil {
+		return nil, fmt.Errorf("read FAT: %w", err)
+	}
+	// Start allocating where the FSInfo next-free hint points.
+	if v.ft == FAT32 && v.g.FSInfoSector != 0 && v.g.FSInfoSector < v.g.ReservedSectors {
+		fs := make([]byte, 512)
+		if _, err := r.ReadAt(fs, int64(v.g.FSInfoSector)*v.bps()); err == nil && validFSInfo(fs) {
+			v.nextFree = binary.LittleEndian.Uint32(fs[492:])
+		}
+	}
+	return v, nil
+}
+
+// openVolumeFile opens an image or device path and the FAT volume on it.
+// A block device opened writable must pass guard.checkInUse first; a nil
+// guard has no overrides.
+func openVolumeFile(path string, writable bool, guard *deviceGuard) (*os.File, *fatVolume, error) {
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeDevice != 0 {
+			if guard == nil {
+				guard = newDeviceGuard()
+			}
+			if err := guard.checkInUse(path); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var w io.WriterAt
+	if writable {
+		w = f
+	}
+	v, err := openFATVolume(f, w)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, v, nil
+}
+
+func (v *fatVolume) bps() int64 { return int64(v.g.BytesPerSector) }
+
+func (v *fatVolume) clusterBytes() int64 {
+	return int64(v.g.SectorsPerCluster) * v.bps()
+}
+
+func (v *fatVolume) totalSectors() uint32 {
+	if v.g.TotalSectors16 != 0 {
+		return uint32(v.g.TotalSectors16)
+	}
+	return v.g.TotalSectors32
+}
+
+// fatStart returns the first sector of FAT copy i.
+func (v *fatVolume) fatStart(i int) int64 {
+	return int64(v.g.ReservedSectors) + int64(i)*int64(v.fatSecs)
+}
+
+// rootStart returns the first sector of the fixed FAT12/16 root directory.
+func (v *fatVolume) rootStart() int64 {
+	return v.fatStart(int(v.g.NumFATs))
+}
+
+func (v *fatVolume) dataStart() int64 {
+	return v.rootStart() + int64(v.rootSecs)
+}
+
+// clusterSector returns the first sector of data cluster c.
+func (v *fatVolume) clusterSector(c uint32) int64 {
+	return v.dataStart() + int64(c-2)*int64(v.g.SectorsPerCluster)
+}
+
+// sectorCluster maps an absolute sector to its data cluster (0 if outside the data area).
+func (v *fatVolume) sectorCluster(sector int64) uint32 {
+	ds := v.dataStart()
+	if sector < ds {
+		return 0
+	}
+	c := uint32((sector-ds)/int64(v.g.SectorsPerCluster)) + 2
+	if c >= v.clusters+2 {
+		return 0
+	}
+	return c
+}
+
+/* ===================== FAT entries and chains ===================== */
+
+// entry returns the FAT entry for cluster c.
+func (v *fatVolume) entry(c uint32) uint32 {
+	switch v.ft {
+	case FAT12:
+		o := c + c/2
+		x := uint32(v.fat[o]) | uint32(v.fat[o+1])<<8
+		if c&1 == 1 {
+			return x >> 4
+		}
+		return x & 0xFFF
+	case FAT16:
+		return uint32(binary.LittleEndian.Uint16(v.fat[c*2:]))
+	default:
+		return binary.LittleEndian.Uint32(v.fat[c*4:]) & 0x0FFFFFFF
+	}
+}
+
+// eocMark returns the end-of-chain value written for the FAT type.
+func (v *fatVolume) eocMark() uint32 {
+	switch v.ft {
+	case FAT12:
+		return 0xFFF
+	case FAT16:
+		return 0xFFFF
+	default:
+		return 0x0FFFFFFF
+	}
+}
+
+// badMark returns the bad-cluster marker for the FAT type.
+func (v *fatVolume) badMark() uint32 {
+	return v.eocMark() - 8
+}
+
+func (v *fatVolume) isEOC(x uint32) bool { return x >= v.eocMark()-7 }
+
+func (v *fatVolume) isBad(x uint32) bool { return x == v.badMark() }
+
+// validCluster reports whether c is a data cluster number on this volume.
+func (v *fatVolume) validCluster(c uint32) bool {
+	return c >= 2 && c < v.clusters+2
+}
+
+// chainError describes a cluster chain that ends early or loops.
+type chainError struct {
+	Start   uint32
+	Cluster uint32
+	Reason  string
+}
+
+func (e *chainError) Error() string {
+	return fmt.Sprintf("chain at cluster %d: %s at cluster %d", e.Start, e.Reason, e.Cluster)
+}
+
+// chain follows the cluster chain that starts at start. On a broken chain
+// it returns the clusters read so far together with a *chainError.
+func (v *fatVolume) chain(start uint32) ([]uint32, error) {
+	if start == 0 {
+		return nil, nil
+	}
+	out := []uint32{}
+	seen := map[uint32]bool{}
+	c := start
+	for {
+		if !v.validCluster(c) {
+			return out, &chainError{start, c, "out-of-range cluster"}
+		}
+		if seen[c] {
+			return out, &chainError{start, c, "loop"}
+		}
+		seen[c] = true
+		out = append(out, c)
+		next := v.entry(c)
+		switch {
+		case v.isEOC(next):
+			return out, nil
+		case next == 0:
+			return out, &chainError{start, c, "free cluster in chain"}
+		case v.isBad(next):
+			return out, &chainError{start, c, "bad cluster in chain"}
+		}
+		c = next
+	}
+}
+
+// freeClusters counts the free clusters in FAT #1.
+func (v *fatVolume) freeClusters() uint32 {
+	n := uint32(0)
+	for c := uint32(2); c < v.clusters+2; c++ {
+		if v.entry(c) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+/* ===================== Directories ===================== */
+
+// dirEntry is one decoded directory entry, with its long name if it has one.
+type dirEntry struct {
+	Name    string // long name if present, else the 8.3 name, e.g. "COMMAND.COM"
+	Long    string // VFAT long name, empty for plain 8.3 entries
+	Short   [11]byte
+	Attr    uint8
+	Cluster uint32
+	Size    uint32
+	Mod     time.Time
+	Slot    int // index of the 32-byte short entry inside its directory
+	LFNSlot int // index of the first LFN entry, equal to Slot without a long name
+}
+
+func (e dirEntry) isDir() bool    { return e.Attr&attrDir != 0 }
+func (e dirEntry) isLabel() bool  { return e.Attr&attrVolumeID != 0 && e.Attr != attrLFN }
+func (e dirEntry) isDotDir() bool { return e.Short[0] == '.' }
+
+// shortName returns the 8.3 name as "NAME.EXT".
+func (e dirEntry) shortName() string { return shortDisplayName(e.Short, e.isLabel()) }
+
+// matches reports whether name refers to e by its long or its short name.
+func (e dirEntry) matches(name string) bool {
+	return strings.EqualFold(e.Name, name) || strings.EqualFold(e.shortName(), name)
+}
+
+// fatDir holds a directory's raw 32-byte entries and where they live on disk.
+type fatDir struct {
+	cluster uint32  // first cluster; 0 for the FAT12/16 fixed root
+	data    []byte  // all entries, concatenated
+	spans   []int64 // absolute byte offset of each cluster (or of the fixed root)
+}
+
+// readDir loads the directory that starts at cluster (0 means the root).
+func (v *fatVolume) readDir(cluster uint32) (*fatDir, error) {
+	if cluster == 0 && v.ft == FAT32 {
+		cluster = v.g.RootCluster
+	}
+	d := &fatDir{cluster: cluster}
+	if cluster == 0 {
+		d.data = make([]byte, int64(v.rootSecs)*v.bps())
+		d.spans = []int64{v.rootStart() * v.bps()}
+		if _, err := v.r.ReadAt(d.data, d.spans[0]); err != nil {
+			return nil, fmt.Errorf("read root directory: %w", err)
+		}
+		return d, nil
+	}
+	chain, err := v.chain(cluster)
+	if err != nil {
+		return nil, fmt.Errorf("directory: %w", err)
+	}
+	cb := v.clusterBytes()
+	d.data = make([]byte, int64(len(chain))*cb)
+	for i, c := range chain {
+		off := v.clusterSector(c) * v.bps()
+		if _, err := v.r.ReadAt(d.data[int64(i)*cb:int64(i+1)*cb], off); err != nil {
+			return nil, fmt.Errorf("read directory cluster %d: %w", c, err)
+		}
+		d.spans = append(d.spans, off)
+	}
+	return d, nil
+}
+
+// slotOffset returns the absolute byte offset of directory slot i.
+func (d *fatDir) slotOffset(i int) int64 {
+	if len(d.spans) == 1 {
+		return d.spans[0] + int64(i)*32
+	}
+	per := len(d.data) / len(d.spans) / 32
+	return d.spans[i/per] + int64(i%per)*32
+}
+
+// entries decodes the live entries of the directory, including the volume
+// label and the "." and ".." entries. Long names are attached to the short
+// entry they belong to; orphaned or mismatched LFN entries are ignored.
+func (d *fatDir) entries() []dirEntry {
+	out := []dirEntry{}
+	var run lfnRun
+	for i := 0; i*32 < len(d.data); i++ {
+		raw := d.data[i*32 : i*32+32]
+		if raw[0] == 0x00 {
+			break
+		}
+		if raw[0] == 0xE5 {
+			run = lfnRun{}
+			continue
+		}
+		if raw[11] == attrLFN {
+			run.add(raw, i)
+			continue
+		}
+		e := decodeDirEntry(raw, i)
+		if !e.isLabel() {
+			if long, ok := run.name(e.Short); ok {
+				e.Long, e.Name, e.LFNSlot = long, long, run.start
+			}
+		}
+		run = lfnRun{}
+		out = append(out, e)
+	}
+	return out
+}
+
+func decodeDirEntry(raw []byte, slot int) dirEntry {
+	e := dirEntry{Attr: raw[11], Size: binary.LittleEndian.Uint32(raw[28:]), Slot: slot, LFNSlot: slot}
+	copy(e.Short[:], raw[0:11])
+	if e.Short[0] == 0x05 {
+		e.Short[0] = 0xE5
+	}
+	e.Cluster = uint32(binary.LittleEndian.Uint16(raw[26:])) | uint32(binary.LittleEndian.Uint16(raw[20:]))<<16
+	e.Mod = dosToTime(binary.LittleEndian.Uint16(raw[24:]), binary.LittleEndian.Uint16(raw[22:]))
+	e.Name = shortDisplayName(e.Short, e.isLabel())
+	return e
+}
+
+// shortDisplayName turns an 11-byte 8.3 name into "NAME.EXT".
+func shortDisplayName(s [11]byte, label bool) string {
+	if label {
+		return strings.TrimRight(string(s[:]), " ")
+	}
+	base := strings.TrimRight(string(s[0:8]), " ")
+	ext := strings.TrimRight(string(s[8:11]), " ")
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// dosToTime decodes a DOS date/time pair as local time.
+func dosToTime(date, tm uint16) time.Time {
+	if date == 0 {
+		return time.Time{}
+	}
+	return time.Date(1980+int(date>>9), time.Month((date>>5)&0x0F), int(date&0x1F),
+		int(tm>>11), int((tm>>5)&0x3F), int(tm&0x1F)*2, 0, time.Local)
+}
+
+// splitFATPath splits an mtools-style path ("::/DOS/FILE.TXT") into components.
+func splitFATPath(p string) []string {
+	p = strings.TrimPrefix(p, "::")
+	p = strings.ReplaceAll(p, "\\", "/")
+	parts := []string{}
+	for _, s := range strings.Split(p, "/") {
+		if s != "" && s != "." {
+			parts = append(parts, s)
+		}
+	}
+	return parts
+}
+
+// rootEntry is the synthetic entry for the root directory.
+func rootEntry() dirEntry {
+	return dirEntry{Name: "/", Attr: attrDir}
+}
+
+// errNotFound is returned when a path does not exist on the volume.
+var errNotFound = errors.New("no such file or directory")
+
+// lookup resolves a volume path to its directory entry. Name matching is
+// case-insensitive, as on DOS.
+func (v *fatVolume) lookup(p string) (dirEntry, error) {
+	cur := rootEntry()
+	for _, name := range splitFATPath(p) {
+		if !cur.isDir() {
+			return dirEntry{}, fmt.Errorf("%s: not a directory", cur.Name)
+		}
+		d, err := v.readDir(cur.Cluster)
+		if err != nil {
+			return dirEntry{}, err
+		}
+		found := false
+		for _, e := range d.entries() {
+			if !e.isLabel() && e.matches(name) {
+				cur, found = e, true
+				break
+			}
+		}
+		if !found {
+			return dirEntry{}, fmt.Errorf("%s: %w", p, errNotFound)
+		}
+	}
+	return cur, nil
+}
+
+// listDir returns the entries of the directory at path, without the volume label.
+func (v *fatVolume) listDir(p string) ([]dirEntry, error) {
+	e, err := v.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !e.isDir() {
+		return []dirEntry{e}, nil
+	}
+	d, err := v.readDir(e.Cluster)
+	if err != nil {
+		return nil, err
+	}
+	out := []dirEntry{}
+	for _, de := range d.entries() {
+		if !de.isLabel() {
+			out = append(out, de)
+		}
+	}
+	return out, nil
+}
+
+// volumeLabel returns the label from the root directory entry, falling back
+// to the boot sector copy.
+func (v *fatVolume) volumeLabel() string {
+	if d, err := v.readDir(0); err == nil {
+		for _, e := range d.entries() {
+			if e.isLabel() {
+				return e.Name
+			}
+		}
+	}
+	if v.label == "NO NAME" {
+		return ""
+	}
+	return v.label
+}
@@ -0,0 +1,488 @@
+// fatwrite.go
+// Write side of FAT12/16/32: cluster allocation, directory entries and
+// keeping every FAT copy plus the FAT32 FSInfo sector in step.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* ===================== FAT updates ===================== */
+
+// setEntry changes the FAT entry for cluster c in the cached FAT and marks
+// the touched sectors dirty so flush writes them to every FAT copy.
+func (v *fatVolume) setEntry(c, val uint32) {
+	if v.dirty == nil {
+		v.dirty = map[int64]bool{}
+	}
+	var off uint32
+	switch v.ft {
+	case FAT12:
+		off = c + c/2
+		x := uint16(v.fat[off]) | uint16(v.fat[off+1])<<8
+		if c&1 == 1 {
+			x = x&0x000F | uint16(val&0xFFF)<<4
+		} else {
+			x = x&0xF000 | uint16(val&0xFFF)
+		}
+		v.fat[off] = byte(x)
+		v.fat[off+1] = byte(x >> 8)
+		v.dirty[int64(off+1)/v.bps()] = true
+	case FAT16:
+		off = c * 2
+		binary.LittleEndian.PutUint16(v.fat[off:], uint16(val))
+	default:
+		off = c * 4
+		old := binary.LittleEndian.Uint32(v.fat[off:])
+		binary.LittleEndian.PutUint32(v.fat[off:], old&0xF0000000|val&0x0FFFFFFF)
+	}
+	v.dirty[int64(off)/v.bps()] = true
+	if val == 0 && c < v.nextFree {
+		v.nextFree = c
+	}
+}
+
+// flush writes dirty FAT sectors to all FAT copies and refreshes FSInfo.
+func (v *fatVolume) flush() error {
+	if v.w == nil {
+		return errors.New("volume is read-only")
+	}
+	bps := v.bps()
+	for s := range v.dirty {
+		buf := v.fat[s*bps : (s+1)*bps]
+		for i := 0; i < int(v.g.NumFATs); i++ {
+			if _, err := v.w.WriteAt(buf, (v.fatStart(i)+s)*bps); err != nil {
+				return fmt.Errorf("write FAT #%d: %w", i+1, err)
+			}
+		}
+	}
+	v.dirty = nil
+	if v.ft == FAT32 {
+		return v.updateFSInfo()
+	}
+	return nil
+}
+
+// validFSInfo reports whether an FSInfo sector carries all three signatures.
+func validFSInfo(fs []byte) bool {
+	return binary.LittleEndian.Uint32(fs[0:]) == 0x41615252 &&
+		binary.LittleEndian.Uint32(fs[484:]) == 0x61417272 &&
+		binary.LittleEndian.Uint32(fs[508:]) == 0xAA550000
+}
+
+// updateFSInfo stores the current free-cluster count and next-free hint in
+// the FSInfo sector and in its copy in the backup boot region.
+func (v *fatVolume) updateFSInfo() error {
+	if v.g.FSInfoSector == 0 || v.g.FSInfoSector >= v.g.ReservedSectors {
+		return nil
+	}
+	free, next := v.freeClusters(), v.allocHint()
+	sectors := []uint16{v.g.FSInfoSector}
+	if bb := v.g.BackupBootSector; bb != 0 && bb+v.g.FSInfoSector < v.g.ReservedSectors {
+		sectors = append(sectors, bb+v.g.FSInfoSector)
+	}
+	fs := make([]byte, 512)
+	for i, sec := range sectors {
+		what := "FSInfo"
+		if i > 0 {
+			what = "backup FSInfo"
+		}
+		off := int64(sec) * v.bps()
+		if _, err := v.r.ReadAt(fs, off); err != nil {
+			return fmt.Errorf("read %s: %w", what, err)
+		}
+		if binary.LittleEndian.Uint32(fs[0:]) != 0x41615252 || binary.LittleEndian.Uint32(fs[484:]) != 0x61417272 {
+			continue
+		}
+		binary.LittleEndian.PutUint32(fs[488:], free)
+		binary.LittleEndian.PutUint32(fs[492:], next)
+		if _, err := v.w.WriteAt(fs, off); err != nil {
+			return fmt.Errorf("write %s: %w", what, err)
+		}
+	}
+	return nil
+}
+
+// allocHint returns the cluster where the next free-cluster search starts.
+func (v *fatVolume) allocHint() uint32 {
+	if v.validCluster(v.nextFree) {
+		return v.nextFree
+	}
+	return 2
+}
+
+// errNoSpace is returned when the volume has too few free clusters.
+var errNoSpace = errors.New("no space left on volume")
+
+// allocChain allocates n free clusters, links them into a chain and returns
+// them in order. Clusters are taken first-fit from the allocation hint, so
+// files stay contiguous when the free space allows it.
+func (v *fatVolume) allocChain(n int) ([]uint32, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	out := make([]uint32, 0, n)
+	start := v.allocHint()
+	for i := uint32(0); i < v.clusters && len(out) < n; i++ {
+		c := 2 + (start-2+i)%v.clusters
+		if v.entry(c) == 0 {
+			out = append(out, c)
+		}
+	}
+	if len(out) < n {
+		return nil, errNoSpace
+	}
+	for i, c := range out {
+		if i+1 < len(out) {
+			v.setEntry(c, out[i+1])
+		} else {
+			v.setEntry(c, v.eocMark())
+		}
+	}
+	v.nextFree = out[len(out)-1] + 1
+	return out, nil
+}
+
+// freeChain releases every cluster of the chain that starts at start.
+func (v *fatVolume) freeChain(start uint32) {
+	chain, _ := v.chain(start)
+	for _, c := range chain {
+		v.setEntry(c, 0)
+	}
+}
+
+// markBad marks the clusters holding the given absolute sectors as bad and
+// returns them in order. Sectors outside the data area are ignored.
+func (v *fatVolume) markBad(sectors []int64) []uint32 {
+	out := []uint32{}
+	for _, s := range sectors {
+		c := v.sectorCluster(s)
+		if c == 0 || v.isBad(v.entry(c)) {
+			continue
+		}
+		v.setEntry(c, v.badMark())
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// clustersFor returns how many clusters size bytes occupy.
+func (v *fatVolume) clustersFor(size int64) int {
+	cb := v.clusterBytes()
+	return int((size + cb - 1) / cb)
+}
+
+// writeChain copies r into the clusters of chain, zero-padding the tail.
+func (v *fatVolume) writeChain(chain []uint32, r io.Reader) error {
+	buf := make([]byte, v.clusterBytes())
+	for _, c := range chain {
+		clear(buf)
+		if _, err := io.ReadFull(r, buf); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		if _, err := v.w.WriteAt(buf, v.clusterSector(c)*v.bps()); err != nil {
+			return fmt.Errorf("write cluster %d: %w", c, err)
+		}
+	}
+	return nil
+}
+
+/* ===================== Directory updates ===================== */
+
+// timeToDOS encodes t as a DOS date/time pair in local time.
+func timeToDOS(t time.Time) (date, tm uint16) {
+	if t.IsZero() || t.Year() < 1980 {
+		return 0x21, 0 // 1980-01-01 00:00:00
+	}
+	if t.Year() > 2107 {
+		t = time.Date(2107, 12, 31, 23, 59, 58, 0, t.Location())
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
+
+// encodeDirEntry builds a 32-byte short directory entry.
+func encodeDirEntry(short [11]byte, attr uint8, cluster, size uint32, mod time.Time) []byte {
+	e := make([]byte, 32)
+	copy(e[0:11], short[:])
+	if e[0] == 0xE5 {
+		e[0] = 0x05
+	}
+	e[11] = attr
+	date, tm := timeToDOS(mod)
+	binary.LittleEndian.PutUint16(e[14:], tm)
+	binary.LittleEndian.PutUint16(e[16:], date)
+	binary.LittleEndian.PutUint16(e[18:], date)
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[22:], tm)
+	binary.LittleEndian.PutUint16(e[24:], date)
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], size)
+	return e
+}
+
+// shortNameChars are the characters DOS accepts in 8.3 names besides A-Z and 0-9.
+const shortNameChars = "!#$%&'()-@^_`{}~"
+
+func validShortChar(r rune) bool {
+	return (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune(shortNameChars, r)
+}
+
+// shortName converts a host name into an 11-byte 8.3 name. Lower case is
+// folded to upper case; anything else that does not fit is an error.
+func shortName(name string) ([11]byte, error) {
+	var s [11]byte
+	for i := range s {
+		s[i] = ' '
+	}
+	up := strings.ToUpper(name)
+	base, ext := up, ""
+	if i := strings.LastIndexByte(up, '.'); i > 0 {
+		base, ext = up[:i], up[i+1:]
+	}
+	if base == "" || len(base) > 8 || len(ext) > 3 {
+		return s, fmt.Errorf("%q is not a valid 8.3 name", name)
+	}
+	for _, r := range base + ext {
+		if !validShortChar(r) {
+			return s, fmt.Errorf("%q is not a valid 8.3 name", name)
+		}
+	}
+	copy(s[0:8], base)
+	copy(s[8:11], ext)
+	return s, nil
+}
+
+// writeSlots stores raw (a multiple of 32 bytes) at slot i of d, in memory and on disk.
+func (v *fatVolume) writeSlots(d *fatDir, i int, raw []byte) error {
+	copy(d.data[i*32:], raw)
+	for k := 0; k*32 < len(raw); k++ {
+		if _, err := v.w.WriteAt(raw[k*32:k*32+32], d.slotOffset(i+k)); err != nil {
+			return fmt.Errorf("write directory entry: %w", err)
+		}
+	}
+	return nil
+}
+
+// findFreeSlots returns the index of n consecutive unused slots in d,
+// growing a cluster-chained directory when it has no such run.
+func (v *fatVolume) findFreeSlots(d *fatDir, n int) (int, error) {
+	run := 0
+	for i := 0; i*32 < len(d.data); i++ {
+		b := d.data[i*32]
+		if b == 0x00 || b == 0xE5 {
+			run++
+			if run == n {
+				return i - n + 1, nil
+			}
+			continue
+		}
+		run = 0
+	}
+	if d.cluster == 0 {
+		return 0, errors.New("root directory is full")
+	}
+	chain, err := v.chain(d.cluster)
+	if err != nil {
+		return 0, err
+	}
+	first := len(d.data)/32 - run
+	last := chain[len(chain)-1]
+	for run < n {
+		nc, err := v.allocChain(1)
+		if err != nil {
+			return 0, err
+		}
+		v.setEntry(last, nc[0])
+		last = nc[0]
+		zero := make([]byte, v.clusterBytes())
+		off := v.clusterSector(last) * v.bps()
+		if _, err := v.w.WriteAt(zero, off); err != nil {
+			return 0, err
+		}
+		d.data = append(d.data, zero...)
+		d.spans = append(d.spans, off)
+		run += len(zero) / 32
+	}
+	return first, nil
+}
+
+// findEntry looks up name (case-insensitively) among the entries of d.
+func findEntry(d *fatDir, name string) (dirEntry, bool) {
+	for _, e := range d.entries() {
+		if !e.isLabel() && e.matches(name) {
+			return e, true
+		}
+	}
+	return dirEntry{}, false
+}
+
+// createEntry adds a new entry called name to the directory at cluster
+// parent. Names that are not plain upper-case 8.3 names get VFAT long name
+// entries and a unique "~N" short alias.
+func (v *fatVolume) createEntry(parent uint32, name string, attr uint8, cluster, size uint32, mod time.Time) (dirEntry, error) {
+	if err := validLongName(name); err != nil {
+		return dirEntry{}, err
+	}
+	d, err := v.readDir(parent)
+	if err != nil {
+		return dirEntry{}, err
+	}
+	if _, ok := findEntry(d, name); ok {
+		return dirEntry{}, fmt.Errorf("%s: already exists", name)
+	}
+	var short [11]byte
+	var lfn []byte
+	if needsLFN(name) {
+		short, err = shortAlias(name, func(s string) bool {
+			_, ok := findEntry(d, s)
+			return ok
+		})
+		if err != nil {
+			return dirEntry{}, err
+		}
+		lfn = encodeLFN(name, short)
+	} else if short, err = shortName(name); err != nil {
+		return dirEntry{}, err
+	}
+	n := len(lfn) / 32
+	slot, err := v.findFreeSlots(d, n+1)
+	if err != nil {
+		return dirEntry{}, err
+	}
+	raw := append(lfn, encodeDirEntry(short, attr, cluster, size, mod)...)
+	if err := v.writeSlots(d, slot, raw); err != nil {
+		return dirEntry{}, err
+	}
+	e := decodeDirEntry(raw[n*32:], slot+n)
+	if n > 0 {
+		e.Long, e.Name, e.LFNSlot = name, name, slot
+	}
+	return e, nil
+}
+
+// mkdir creates the subdirectory name inside the directory at cluster parent.
+func (v *fatVolume) mkdir(parent uint32, name string, mod time.Time) (dirEntry, error) {
+	chain, err := v.allocChain(1)
+	if err != nil {
+		return dirEntry{}, err
+	}
+	c := chain[0]
+	buf := make([]byte, v.clusterBytes())
+	dot := [11]byte{'.', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' ', ' '}
+	copy(buf[0:], encodeDirEntry(dot, attrDir, c, 0, mod))
+	dot[1] = '.'
+	up := parent
+	if v.ft == FAT32 && up == v.g.RootCluster {
+		up = 0
+	}
+	copy(buf[32:], encodeDirEntry(dot, attrDir, up, 0, mod))
+	if _, err := v.w.WriteAt(buf, v.clusterSector(c)*v.bps()); err != nil {
+		v.freeChain(c)
+		return dirEntry{}, err
+	}
+	// The cluster is allocated on disk before an entry points at it.
+	if err := v.flush(); err != nil {
+		v.freeChain(c)
+		return dirEntry{}, err
+	}
+	e, err := v.createEntry(parent, name, attrDir, c, 0, mod)
+	if err != nil {
+		v.freeChain(c)
+		_ = v.flush()
+		return dirEntry{}, err
+	}
+	return e, v.flush()
+}
+
+// putFile stores size bytes from r as name inside the directory at cluster
+// parent. With overwrite, an existing file of that name is replaced. As in
+// defrag, the data goes to a chain of its own that is flushed to the FATs
+// before the entry points at it, and the old chain is freed (and flushed)
+// only after the entry was switched, so a failure at any point leaves the
+// old file intact and no entry pointing at free clusters. On error the
+// clusters it allocated are released again.
+func (v *fatVolume) putFile(parent uint32, name string, r io.Reader, size int64, mod time.Time, overwrite bool) (dirEntry, error) {
+	if size > 0xFFFFFFFF {
+		return dirEntry{}, fmt.Errorf("%s: too large for FAT (%d bytes)", name, size)
+	}
+	d, err := v.readDir(parent)
+	if err != nil {
+		return dirEntry{}, err
+	}
+	old, exists := findEntry(d, name)
+	if exists && (!overwrite || old.isDir()) {
+		return dirEntry{}, fmt.Errorf("%s: already exists", name)
+	}
+	chain, err := v.allocChain(v.clustersFor(size))
+	if err != nil {
+		return dirEntry{}, fmt.Errorf("%s: %w", name, err)
+	}
+	first := uint32(0)
+	if len(chain) > 0 {
+		first = chain[0]
+	}
+	if err := v.writeChain(chain, r); err != nil {
+		v.freeChain(first)
+		return dirEntry{}, err
+	}
+	if err := v.flush(); err != nil {
+		v.freeChain(first)
+		return dirEntry{}, err
+	}
+	// From here the chain is on disk; a failure frees it there too.
+	release := func() {
+		v.freeChain(first)
+		_ = v.flush()
+	}
+	if !exists {
+		e, err := v.createEntry(parent, name, attrArchive, first, uint32(size), mod)
+		if err != nil {
+			release()
+			return dirEntry{}, err
+		}
+		return e, v.flush()
+	}
+	raw := encodeDirEntry(old.Short, attrArchive, first, uint32(size), mod)
+	if err := v.writeSlots(d, old.Slot, raw); err != nil {
+		release()
+		return dirEntry{}, err
+	}
+	v.freeChain(old.Cluster)
+	if err := v.flush(); err != nil {
+		return dirEntry{}, err
+	}
+	e := decodeDirEntry(raw, old.Slot)
+	e.Long, e.Name, e.LFNSlot = old.Long, old.Name, old.LFNSlot
+	return e, nil
+}
+
+// mkdirAll makes sure every directory of path exists and returns the last one.
+func (v *fatVolume) mkdirAll(p string, mod time.Time) (dirEntry, error) {
+	cur := rootEntry()
+	for _, name := range splitFATPath(p) {
+		d, err := v.readDir(cur.Cluster)
+		if err != nil {
+			return dirEntry{}, err
+		}
+		if e, ok := findEntry(d, name); ok {
+			if !e.isDir() {
+				return dirEntry{}, fmt.Errorf("%s: not a directory", e.Name)
+			}
+			cur = e
+			continue
+		}
+		if cur, err = v.mkdir(cur.Cluster, name, mod); err != nil {
+			return dirEntry{}, err
+		}
+	}
+	return cur, nil
+}
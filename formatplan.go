@@ -0,0 +1,274 @@
+// formatplan.go
+// Format engine: the format command turns the layout into an ordered plan
+// of sector runs, then runs it against a sink (image file, device or the
+// drive emulator) or prints it for --dry-run.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"mkfat/retrodfrg"
+)
+
+// formatPlanVersion is bumped whenever the JSON plan changes incompatibly.
+const formatPlanVersion = 1
+
+// formatSink receives the writes of a format plan: an image file, a device
+// or the emulator. Sinks that can also read back (io.ReaderAt) get bad
+// sector detection in the full format step.
+type formatSink interface {
+	io.WriterAt
+	Sync() error
+}
+
+// formatRW is a sink that reads back, such as an image file or a device.
+type formatRW interface {
+	formatSink
+	io.ReaderAt
+}
+
+// emulatorSink discards the writes, paced like a drive when w is a
+// pacedWriter.
+type emulatorSink struct{ io.WriterAt }
+
+func (emulatorSink) Sync() error { return nil }
+
+// trackBytes lets chunkFor see through the sink to a pacedWriter, so the
+// writes stay a track long and the display keeps up with the drive.
+func (s emulatorSink) trackBytes() int64 { return chunkFor(s.WriterAt, math.MaxInt64) }
+
+// Kinds of plan steps.
+const (
+	stepWrite = "write" // write the payload
+	stepZero  = "zero"  // write zeroes
+	stepFull  = "full"  // write zeroes, checking each sector when the sink reads back
+)
+
+// formatStep is one run of sectors of the plan.
+type formatStep struct {
+	Phase  string `json:"phase"`
+	Op     string `json:"op"`
+	Kind   string `json:"kind"`
+	Start  int64  `json:"start"`
+	Count  int64  `json:"count"`
+	SHA256 string `json:"sha256,omitempty"`
+
+	payload func() []byte // for stepWrite; Count sectors long
+}
+
+// formatPlan is the ordered list of writes that makes a file system, plus
+// the file-system level work (bad cluster marking, --from-dir) done on the
+// written volume afterwards.
+type formatPlan struct {
+	Version int          `json:"version"`
+	FAT     int          `json:"fat"`
+	Bytes   int64        `json:"bytes"`
+	Sectors int64        `json:"sectors"`
+	Phases  []string     `json:"phases"`
+	Steps   []formatStep `json:"steps"`
+	After   []string     `json:"after,omitempty"`
+}
+
+func (p *formatPlan) add(s formatStep) {
+	if len(p.Phases) == 0 || p.Phases[len(p.Phases)-1] != s.Phase {
+		p.Phases = append(p.Phases, s.Phase)
+	}
+	p.Steps = append(p.Steps, s)
+}
+
+// buildFormatPlan lays out the writes of a format: boot sector (and on
+// FAT32 the rest of the reserved area), each FAT copy, the root directory
+// with the label entry and, for a full format, the rest of the data area.
+func buildFormatPlan(ft FATType, g geom, fatSecs, rootSecs, clusters uint32, size int64, label, oem string, serial uint32, full bool) *formatPlan {
+	p := &formatPlan{Version: formatPlanVersion, FAT: int(ft), Bytes: size, Sectors: size / 512}
+
+	var boot []byte
+	if ft == FAT32 {
+		boot = buildBootSector32(g, label, oem, serial)
+	} else {
+		boot = buildBootSector1216(ft, g, label, oem, serial)
+	}
+	p.add(formatStep{Phase: "Boot", Op: "Write boot sector", Kind: stepWrite, Start: 0, Count: 1,
+		payload: func() []byte { return boot }})
+	if ft == FAT32 {
+		p.add(formatStep{Phase: "Boot", Op: "Write FSInfo and backup boot region", Kind: stepWrite, Start: 1, Count: int64(g.ReservedSectors) - 1,
+			payload: func() []byte { return buildReservedFAT32(g, boot, clusters)[512:] }})
+	}
+
+	var fat []byte
+	fatPayload := func() []byte {
+		if fat == nil {
+			fat = make([]byte, int64(fatSecs)*512)
+			if ft == FAT32 {
+				initFAT32(fat, g.Media)
+			} else {
+				initFAT1216(ft, fat, g.Media)
+			}
+		}
+		return fat
+	}
+	for i := int64(0); i < int64(g.NumFATs); i++ {
+		op := "Initialize FAT #1"
+		if i > 0 {
+			op = fmt.Sprintf("Duplicate FAT #%d", i+1)
+		}
+		p.add(formatStep{Phase: fmt.Sprintf("FAT%d", i+1), Op: op, Kind: stepWrite,
+			Start: int64(g.ReservedSectors) + i*int64(fatSecs), Count: int64(fatSecs), payload: fatPayload})
+	}
+
+	// The root directory: the fixed area on FAT12/16, cluster RootCluster
+	// on FAT32. It starts with the label entry.
+	absData := int64(g.ReservedSectors) + int64(g.NumFATs)*int64(fatSecs)
+	rootStart, rootCount := absData, int64(rootSecs)
+	if ft == FAT32 {
+		rootStart += int64(g.RootCluster-2) * int64(g.SectorsPerCluster)
+		rootCount = int64(g.SectorsPerCluster)
+	} else {
+		absData += int64(rootSecs)
+	}
+	root := formatStep{Phase: "Root", Op: "Clear root directory", Kind: stepZero, Start: rootStart, Count: rootCount}
+	if label != "" {
+		root.Kind = stepWrite
+		root.Op = "Clear root directory and write the label"
+		root.payload = func() []byte {
+			b := make([]byte, rootCount*512)
+			copy(b, buildRootLabelEntry(label))
+			return b
+		}
+	}
+	p.add(root)
+
+	// A full format zeroes and checks the rest of the data area; the FAT32
+	// root cluster was written above and is skipped.
+	if full {
+		start := absData
+		if ft == FAT32 {
+			start += int64(g.SectorsPerCluster)
+		}
+		if n := size/512 - start; n > 0 {
+			p.add(formatStep{Phase: "Data", Op: "Full format: zero and check data area", Kind: stepFull, Start: start, Count: n})
+		}
+	}
+	return p
+}
+
+// formatRun is the display and I/O policy a plan runs with.
+type formatRun struct {
+	ui           *retrodfrg.UI
+	pt           *progressTracker
+	start        time.Time
+	emuRate      float64
+	emulate      bool
+	systemRanges [][2]int64
+	syncMode     string
+	verify       bool
+	spt          int
+}
+
+func (r *formatRun) status(op string) {
+	updateStatusLines(r.ui, r.pt, r.start, op, r.emuRate, r.emulate, r.systemRanges)
+	r.ui.LayoutAndDraw()
+}
+
+// run writes the plan to sink in order, syncing after every step, and
+// returns the bad sectors found by the full format step. A failing full
+// format is reported as a warning, since what was found so far is still
+// worth marking.
+func (p *formatPlan) run(sink formatSink, r *formatRun) ([]int64, error) {
+	var bad []int64
+	for i, s := range p.Steps {
+		r.pt.report.phaseStart(s.Phase, s.Op)
+		r.status(s.Op)
+		var err error
+		switch s.Kind {
+		case stepWrite:
+			err = writeSpanWithStatus(sink, s.Start, s.payload(), r.ui, r.pt, s.Op, r.start, r.emuRate, r.emulate, r.systemRanges)
+		case stepZero:
+			err = zeroSpanWithStatus(sink, s.Start, s.Count, r.ui, r.pt, s.Op, r.start, r.emuRate, r.emulate, r.systemRanges)
+		case stepFull:
+			bad, err = r.full(sink, s)
+			if err != nil && !errors.Is(err, retrodfrg.ErrInterrupted) {
+				fmt.Fprintf(os.Stderr, "\nWARNING: %v\n", err)
+				err = nil
+			}
+		}
+		if err != nil {
+			return bad, err
+		}
+		if err := sink.Sync(); err != nil {
+			return bad, err
+		}
+		if i+1 == len(p.Steps) || p.Steps[i+1].Phase != s.Phase {
+			r.ui.SetPhaseDone(s.Phase)
+		}
+		r.status(s.Op)
+		r.pt.report.phaseEnd(s.Phase, s.Op)
+	}
+	return bad, nil
+}
+
+// full runs a full format step. Only sinks that read back can be checked;
+// the emulator just paces the writes.
+func (r *formatRun) full(sink formatSink, s formatStep) ([]int64, error) {
+	rw, ok := sink.(formatRW)
+	if !ok {
+		return nil, zeroSpanWithStatus(sink, s.Start, s.Count, r.ui, r.pt, s.Op, r.start, r.emuRate, r.emulate, r.systemRanges)
+	}
+	if strings.ToLower(r.syncMode) == "sector" {
+		return fullFormatDataArea(rw, s.Start, s.Count, r.ui, r.pt, s.Op+" (sector)", r.start, r.systemRanges)
+	}
+	bad, err := fullFormatTrack(rw, s.Start, s.Count, r.spt, r.ui, r.pt, r.syncMode, s.Op+" (track)", r.start, r.systemRanges)
+	if r.verify && err == nil {
+		r.status("Verify data area (track)")
+		_ = verifyTrackRead(rw, s.Start, s.Count, r.spt)
+	}
+	return bad, err
+}
+
+// hash fills in the SHA-256 of every payload, so two plans can be compared.
+func (p *formatPlan) hash() {
+	for i := range p.Steps {
+		if s := &p.Steps[i]; s.payload != nil {
+			sum := sha256.Sum256(s.payload())
+			s.SHA256 = hex.EncodeToString(sum[:])
+		}
+	}
+}
+
+// print writes the plan for --dry-run, as "text" or "json".
+func (p *formatPlan) print(w io.Writer, format string) error {
+	p.hash()
+	if format == "json" {
+		b, err := json.MarshalIndent(p, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+	fmt.Fprintf(w, "Format plan (version %d): FAT%d, %d bytes, %d sectors\n\n", p.Version, p.FAT, p.Bytes, p.Sectors)
+	fmt.Fprintf(w, "  %-3s %-5s %-5s %10s %10s  %-40s %s\n", "#", "PHASE", "KIND", "START", "COUNT", "OPERATION", "SHA-256")
+	for i, s := range p.Steps {
+		sum := "-"
+		if s.SHA256 != "" {
+			sum = s.SHA256[:16]
+		}
+		fmt.Fprintf(w, "  %-3d %-5s %-5s %10d %10d  %-40s %s\n", i+1, s.Phase, s.Kind, s.Start, s.Count, s.Op, sum)
+	}
+	if len(p.After) > 0 {
+		fmt.Fprintln(w, "\nThen, on the written volume:")
+		for _, a := range p.After {
+			fmt.Fprintf(w, "  - %s\n", a)
+		}
+	}
+	return nil
+}
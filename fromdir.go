@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"unicode/utf16"
+)
+
+/* ===================== Populate from a host tree ===================== */
+
+// treeStats summarises a host directory tree copied into a volume.
+type treeStats struct {
+	Files    int
+	Dirs     int
+	Bytes    int64
+	Clusters int // data clusters the tree needs, directories included
+	RootSlot int // directory slots used in the root directory
+}
+
+// entrySlots returns the directory slots a name takes, LFN entries included.
+func entrySlots(name string) int {
+	if !needsLFN(name) {
+		return 1
+	}
+	return 1 + (len(utf16.Encode([]rune(name)))+12)/13
+}
+
+// treeEntryInfo returns the file info used to copy p. Symlinks to regular
+// files are followed; any other symlink is returned as a symlink, so it is
+// skipped and a link back up the tree cannot be walked forever.
+func treeEntryInfo(p string) (os.FileInfo, error) {
+	fi, err := os.Lstat(p)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return fi, err
+	}
+	if t, err := os.Stat(p); err == nil && t.Mode().IsRegular() {
+		return t, nil
+	}
+	return fi, nil
+}
+
+// planTree walks a host tree and works out how much of the volume it needs.
+// The root directory is assumed to exist already, so only its overflow
+// clusters are counted (FAT32) or its slots reported (FAT12/16).
+func planTree(root string, clusterBytes int64) (treeStats, error) {
+	var st treeStats
+	var walk func(dir string, isRoot bool) error
+	walk = func(dir string, isRoot bool) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		slots := 0
+		if !isRoot {
+			slots = 2 // "." and ".."
+		}
+		for _, de := range entries {
+			p := filepath.Join(dir, de.Name())
+			fi, err := treeEntryInfo(p)
+			if err != nil {
+				return err
+			}
+			switch {
+			case fi.IsDir():
+				st.Dirs++
+				if err := walk(p, false); err != nil {
+					return err
+				}
+			case fi.Mode().IsRegular():
+				st.Files++
+				st.Bytes += fi.Size()
+				st.Clusters += int((fi.Size() + clusterBytes - 1) / clusterBytes)
+			default:
+				continue
+			}
+			slots += entrySlots(de.Name())
+		}
+		if isRoot {
+			st.RootSlot = slots
+			return nil
+		}
+		n := int((int64(slots)*32 + clusterBytes - 1) / clusterBytes)
+		st.Clusters += n
+		return nil
+	}
+	err := walk(root, true)
+	return st, err
+}
+
+// checkTreeFits fails when the tree planned in st cannot fit a freshly
+// formatted volume with the given layout, of whose clusters bad are marked
+// bad.
+func checkTreeFits(ft FATType, g geom, clusters uint32, bad int, st treeStats, label string) error {
+	clusterBytes := int64(g.SectorsPerCluster) * int64(g.BytesPerSector)
+	free := int(clusters) - bad
+	rootSlots := st.RootSlot
+	if label != "" {
+		rootSlots++
+	}
+	if ft == FAT32 {
+		free-- // root directory cluster
+		if extra := int((int64(rootSlots)*32+clusterBytes-1)/clusterBytes) - 1; extra > 0 {
+			st.Clusters += extra
+		}
+	} else if rootSlots > int(g.RootEntries) {
+		return fmt.Errorf("tree needs %d root directory entries, volume has %d", rootSlots, g.RootEntries)
+	}
+	if st.Clusters > free {
+		msg := fmt.Sprintf("tree needs %d clusters (%s), volume has %d free (%s)",
+			st.Clusters, human(int64(st.Clusters)*clusterBytes), free, human(int64(free)*clusterBytes))
+		if bad > 0 {
+			msg += fmt.Sprintf(" after %d bad cluster(s)", bad)
+		}
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// putTree copies the contents of hostDir into the directory at cluster parent.
+func putTree(v *fatVolume, parent uint32, hostDir string) (treeStats, error) {
+	var st treeStats
+	entries, err := os.ReadDir(hostDir)
+	if err != nil {
+		return st, err
+	}
+	for _, de := range entries {
+		p := filepath.Join(hostDir, de.Name())
+		fi, err := treeEntryInfo(p)
+		if err != nil {
+			return st, err
+		}
+		switch {
+		case fi.IsDir():
+			e, err := v.mkdir(parent, de.Name(), stampTime(fi.ModTime()))
+			if err != nil {
+				return st, fmt.Errorf("%s: %w", p, err)
+			}
+			sub, err := putTree(v, e.Cluster, p)
+			st.Files += sub.Files
+			st.Dirs += sub.Dirs + 1
+			st.Bytes += sub.Bytes
+			if err != nil {
+				return st, err
+			}
+		case fi.Mode().IsRegular():
+			if err := putHostFile(v, parent, p, de.Name(), false); err != nil {
+				return st, fmt.Errorf("%s: %w", p, err)
+			}
+			st.Files++
+			st.Bytes += fi.Size()
+		default:
+			fmt.Fprintf(os.Stderr, "WARNING: skipping %s (not a regular file or directory)\n", p)
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+/* ===================== get / extract ===================== */
+
+// readFile copies the data of e to w and returns the clusters it used. A
+// chain that is broken or shorter than the file size is copied as far as it
+// goes and described in damage; err is only set for I/O failures.
+func (v *fatVolume) readFile(e dirEntry, w io.Writer) (chain []uint32, damage string, err error) {
+	chain, cerr := v.chain(e.Cluster)
+	need := v.clustersFor(int64(e.Size))
+	remain := int64(e.Size)
+	buf := make([]byte, v.clusterBytes())
+	for i, c := range chain {
+		if i >= need {
+			break
+		}
+		if _, err := v.r.ReadAt(buf, v.clusterSector(c)*v.bps()); err != nil {
+			return chain, "", fmt.Errorf("read cluster %d: %w", c, err)
+		}
+		n := int64(len(buf))
+		if remain < n {
+			n = remain
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return chain, "", err
+		}
+		remain -= n
+	}
+	switch {
+	case cerr != nil:
+		damage = fmt.Sprintf("truncated, %d of %d bytes recovered: %v", int64(e.Size)-remain, e.Size, cerr)
+	case len(chain) < need:
+		damage = fmt.Sprintf("truncated, chain has %d of %d clusters", len(chain), need)
+	case len(chain) > need:
+		damage = fmt.Sprintf("chain has %d clusters but size needs %d", len(chain), need)
+	}
+	return chain, damage, nil
+}
+
+// extractor copies files out of a volume and collects damage it runs into.
+type extractor struct {
+	v        *fatVolume
+	owners   map[uint32]string // cluster -> volume path that claimed it first
+	problems []string
+	files    int
+	bytes    int64
+}
+
+func newExtractor(v *fatVolume) *extractor {
+	return &extractor{v: v, owners: map[uint32]string{}}
+}
+
+func (x *extractor) report(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	x.problems = append(x.problems, msg)
+	fmt.Fprintf(os.Stderr, "WARNING: %s\n", msg)
+}
+
+// claim records that volPath uses chain and reports clusters already used
+// by another path. It returns false if any cluster was cross-linked.
+func (x *extractor) claim(volPath string, chain []uint32) bool {
+	ok := true
+	for _, c := range chain {
+		if other, dup := x.owners[c]; dup {
+			x.report("%s: cross-linked with %s at cluster %d", volPath, other, c)
+			ok = false
+			continue
+		}
+		x.owners[c] = volPath
+	}
+	return ok
+}
+
+// extract writes entry e (found at volPath) to hostPath, recursing into
+// directories. Cluster 0 means the root directory only for the root entry
+// itself; a subdirectory without a cluster is reported as damage.
+func (x *extractor) extract(e dirEntry, volPath, hostPath string) error {
+	if !e.isDir() {
+		return x.extractFile(e, volPath, hostPath)
+	}
+	start := e.Cluster
+	if start == 0 {
+		if volPath != "::/" {
+			x.report("%s: directory entry has no start cluster", volPath)
+			return nil
+		}
+		if x.v.ft == FAT32 {
+			start = x.v.g.RootCluster
+		}
+	}
+	if start != 0 {
+		chain, _ := x.v.chain(start)
+		if !x.claim(volPath, chain) {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(hostPath, 0755); err != nil {
+		return err
+	}
+	d, err := x.v.readDir(e.Cluster)
+	if err != nil {
+		x.report("%s: %v", volPath, err)
+		return nil
+	}
+	for _, c := range d.entries() {
+		if c.isLabel() || c.isDotDir() {
+			continue
+		}
+		child := strings.TrimSuffix(volPath, "/") + "/" + c.Name
+		p, err := hostChild(hostPath, c.Name)
+		if err != nil {
+			x.report("%s: %v", child, err)
+			continue
+		}
+		if err := x.extract(c, child, p); err != nil {
+			return err
+		}
+	}
+	if !e.Mod.IsZero() {
+		_ = os.Chtimes(hostPath, e.Mod, e.Mod)
+	}
+	return nil
+}
+
+func (x *extractor) extractFile(e dirEntry, volPath, hostPath string) error {
+	out, err := os.Create(hostPath)
+	if err != nil {
+		return err
+	}
+	chain, damage, rerr := x.v.readFile(e, out)
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if rerr != nil {
+		return fmt.Errorf("%s: %w", volPath, rerr)
+	}
+	x.claim(volPath, chain)
+	if damage != "" {
+		x.report("%s: %s", volPath, damage)
+	}
+	if !e.Mod.IsZero() {
+		_ = os.Chtimes(hostPath, e.Mod, e.Mod)
+	}
+	x.files++
+	x.bytes += int64(e.Size)
+	return nil
+}
+
+// hostSafeName replaces characters that cannot appear in a host file name,
+// and renames the names "", "." and ".." that would not create a new entry.
+func hostSafeName(name string) string {
+	switch name {
+	case "", ".", "..":
+		return strings.Repeat("_", max(len(name), 1))
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// hostChild returns the host path for the volume name inside dir. Names come
+// from untrusted media, so the result is checked to stay inside dir.
+func hostChild(dir, name string) (string, error) {
+	p := filepath.Join(dir, hostSafeName(name))
+	if rel, err := filepath.Rel(dir, p); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("name %q would be written outside %s", name, dir)
+	}
+	return p, nil
+}
+
+// finish prints a summary and turns collected damage into an error.
+func (x *extractor) finish() error {
+	fmt.Printf("%d file(s), %d bytes extracted\n", x.files, x.bytes)
+	if len(x.problems) > 0 {
+		return fmt.Errorf("%d damaged chain(s) reported", len(x.problems))
+	}
+	return nil
+}
+
+func newGetCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "get <image|device> <::/path> [host-dest]",
+		Short: "Copy a file or directory out of a FAT12/16/32 image or device",
+		Args:  cobra.RangeArgs(2, 3),
+		RunE: func(_ *cobra.Command, args []string) error {
+			dest := "."
+			if len(args) == 3 {
+				dest = args[2]
+			}
+			f, v, err := openVolumeFile(args[0], false, nil)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			e, err := v.lookup(args[1])
+			if err != nil {
+				return err
+			}
+			if st, err := os.Stat(dest); err == nil && st.IsDir() && len(splitFATPath(args[1])) > 0 {
+				if dest, err = hostChild(dest, e.Name); err != nil {
+					return err
+				}
+			}
+			x := newExtractor(v)
+			if err := x.extract(e, "::/"+strings.Join(splitFATPath(args[1]), "/"), dest); err != nil {
+				return err
+			}
+			return x.finish()
+		},
+	}
+}
+
+func newExtractCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "extract <image|device> <host-dir>",
+		Short: "Copy the whole volume of a FAT12/16/32 image or device to a host directory",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			f, v, err := openVolumeFile(args[0], false, nil)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			x := newExtractor(v)
+			if err := x.extract(rootEntry(), "::/", args[1]); err != nil {
+				return err
+			}
+			return x.finish()
+		},
+	}
+}
@@ -0,0 +1,224 @@
+// guard.go
+// Safety guard for commands that write a whole device: refuse mounted
+// disks, disks in use by another block device (RAID, LVM, dm-crypt) and
+// large fixed disks unless the matching override flag is given. Commands
+// that change a volume in place get the mounted and in-use checks.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// deviceGuard checks a device before it is written. The mount table and
+// sysfs are read from MountsFile and SysfsRoot, so the checks can run
+// against a fixture tree. Checks whose source does not exist (no sysfs on
+// macOS or Windows, an image file instead of a device) are skipped.
+type deviceGuard struct {
+	MountsFile string // mount table in /proc/self/mounts format
+	SysfsRoot  string // normally /sys
+
+	AllowMounted bool
+	AllowInUse   bool
+	AllowFixed   bool
+	MaxFixed     int64 // largest non-removable disk accepted without AllowFixed
+}
+
+// defaultMaxFixed is the default --max-fixed-size: larger than any card a
+// built-in reader reports as fixed, smaller than most system disks.
+const defaultMaxFixed = 32 << 30
+
+func newDeviceGuard() *deviceGuard {
+	return &deviceGuard{MountsFile: "/proc/self/mounts", SysfsRoot: "/sys", MaxFixed: defaultMaxFixed}
+}
+
+// addFlags adds the override flags of g to cmd.
+func (g *deviceGuard) addFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&g.AllowMounted, "allow-mounted", false, "write the device even if it or one of its partitions is mounted")
+	cmd.Flags().BoolVar(&g.AllowInUse, "allow-in-use", false, "write the device even if another block device (RAID, LVM, dm-crypt) holds it")
+	cmd.Flags().BoolVar(&g.AllowFixed, "allow-fixed", false, "write a non-removable disk larger than --max-fixed-size")
+	cmd.Flags().Var(&sizeFlag{&g.MaxFixed}, "max-fixed-size", "largest non-removable disk written without --allow-fixed")
+}
+
+// addInUseFlags adds only the mounted and in-use overrides, for commands
+// that change a volume in place rather than writing the whole device.
+func (g *deviceGuard) addInUseFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&g.AllowMounted, "allow-mounted", false, "change the volume even if its device is mounted")
+	cmd.Flags().BoolVar(&g.AllowInUse, "allow-in-use", false, "change the volume even if another block device (RAID, LVM, dm-crypt) holds its device")
+}
+
+// sizeFlag is a pflag.Value for sizes like 32g.
+type sizeFlag struct{ p *int64 }
+
+func (s *sizeFlag) String() string {
+	if s.p == nil {
+		return ""
+	}
+	return human(*s.p)
+}
+
+func (s *sizeFlag) Set(v string) error {
+	n, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+	*s.p = n
+	return nil
+}
+
+func (s *sizeFlag) Type() string { return "size" }
+
+// check returns an error naming the reason and the override flag when
+// device must not be written.
+func (g *deviceGuard) check(device string) error {
+	if err := g.checkInUse(device); err != nil {
+		return err
+	}
+	if !g.AllowFixed && g.MaxFixed > 0 {
+		sys := filepath.Join(g.SysfsRoot, "class", "block", g.name(device))
+		if disk, ok := g.disk(sys); ok && readSysfs(disk, "removable") != "1" {
+			size := g.size(disk, device)
+			if size > g.MaxFixed {
+				return fmt.Errorf("refusing to write %s: non-removable disk of %s is larger than --max-fixed-size %s (override with --allow-fixed)", device, human(size), human(g.MaxFixed))
+			}
+		}
+	}
+	return nil
+}
+
+// name returns the kernel name of device, following /dev symlinks.
+func (g *deviceGuard) name(device string) string {
+	path := device
+	if p, err := filepath.EvalSymlinks(device); err == nil {
+		path = p
+	}
+	return filepath.Base(path)
+}
+
+// checkInUse is the part of check that also applies to changing a volume
+// in place: device and its partitions must be neither mounted nor held by
+// another block device.
+func (g *deviceGuard) checkInUse(device string) error {
+	name := g.name(device)
+	sys := filepath.Join(g.SysfsRoot, "class", "block", name)
+	names := append([]string{name}, g.partitions(sys)...)
+
+	if !g.AllowMounted {
+		if dev, mnt := g.mounted(names); dev != "" {
+			return fmt.Errorf("refusing to write %s: %s is mounted on %s (unmount it, or override with --allow-mounted)", device, dev, mnt)
+		}
+	}
+	if !g.AllowInUse {
+		for _, n := range names {
+			dir := filepath.Join(sys, "holders")
+			if n != name {
+				dir = filepath.Join(sys, n, "holders")
+			}
+			if hs, err := os.ReadDir(dir); err == nil && len(hs) > 0 {
+				return fmt.Errorf("refusing to write %s: /dev/%s is in use by %s (override with --allow-in-use)", device, n, hs[0].Name())
+			}
+		}
+	}
+	return nil
+}
+
+// disk returns the sysfs directory of the whole disk for the block device
+// at sys, which is the parent directory for a partition. It is false when
+// sysfs does not know the device.
+func (g *deviceGuard) disk(sys string) (string, bool) {
+	dir, err := filepath.EvalSymlinks(sys)
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		return filepath.Dir(dir), true
+	}
+	return dir, true
+}
+
+// partitions lists the partitions sysfs shows under the disk directory sys.
+func (g *deviceGuard) partitions(sys string) []string {
+	return sysfsList(sys, func(e string) bool {
+		_, err := os.Stat(filepath.Join(sys, e, "partition"))
+		return err == nil
+	})
+}
+
+// mounted returns the first mount table entry whose source is one of the
+// block devices names, and where it is mounted.
+func (g *deviceGuard) mounted(names []string) (device, mountpoint string) {
+	f, err := os.Open(g.MountsFile)
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+	want := map[string]bool{}
+	for _, n := range names {
+		want[n] = true
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// format: <src> <target> <fstype> <opts> ...
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		src := fields[0]
+		if p, err := filepath.EvalSymlinks(src); err == nil {
+			src = p // /dev/disk/by-uuid/... and /dev/root
+		}
+		if want[filepath.Base(src)] {
+			return fields[0], unescapeMount(fields[1])
+		}
+	}
+	return "", ""
+}
+
+// unescapeMount undoes the octal escapes (\040 for space) of the mount table.
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// size returns the disk size from sysfs (in 512-byte units whatever the
+// sector size) or, failing that, from the device itself.
+func (g *deviceGuard) size(sys, device string) int64 {
+	if n, err := strconv.ParseInt(readSysfs(sys, "size"), 10, 64); err == nil {
+		return n * 512
+	}
+	f, err := os.Open(device)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	n, _ := getDeviceSize(f)
+	return n
+}
+
+// readSysfs returns the trimmed contents of a sysfs attribute, or "".
+func readSysfs(dir, attr string) string {
+	b, err := os.ReadFile(filepath.Join(dir, attr))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sysfsFixture is a fake sysfs tree: devices live under
+// devices/<bus>/block/<disk>[/<partition>] and class/block links to them,
+// as on Linux.
+type sysfsFixture struct {
+	t    *testing.T
+	root string
+	dirs map[string]string // block device name -> its directory
+}
+
+func newSysfsFixture(t *testing.T) *sysfsFixture {
+	t.Helper()
+	f := &sysfsFixture{t: t, root: t.TempDir(), dirs: map[string]string{}}
+	f.mkdir(filepath.Join(f.root, "class", "block"))
+	return f
+}
+
+func (f *sysfsFixture) mkdir(dir string) {
+	f.t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// write sets the attributes attrs ("queue/logical_block_size", "size", ...)
+// of the device directory dir.
+func (f *sysfsFixture) write(dir string, attrs map[string]string) {
+	f.t.Helper()
+	for k, v := range attrs {
+		p := filepath.Join(dir, k)
+		f.mkdir(filepath.Dir(p))
+		if err := os.WriteFile(p, []byte(v+"\n"), 0o644); err != nil {
+			f.t.Fatal(err)
+		}
+	}
+}
+
+func (f *sysfsFixture) link(name, dir string) {
+	f.t.Helper()
+	rel, err := filepath.Rel(filepath.Join(f.root, "class", "block"), dir)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.Symlink(rel, filepath.Join(f.root, "class", "block", name)); err != nil {
+		f.t.Skipf("symlinks not available: %v", err)
+	}
+	f.dirs[name] = dir
+}
+
+// disk adds the whole disk name on bus, e.g. "pci0000:00/usb1/1-1/host6".
+func (f *sysfsFixture) disk(bus, name string, attrs map[string]string) {
+	f.t.Helper()
+	dir := filepath.Join(f.root, "devices", bus, "block", name)
+	f.mkdir(filepath.Join(dir, "holders"))
+	f.write(dir, attrs)
+	f.link(name, dir)
+}
+
+// partition adds partition name to the disk added before.
+func (f *sysfsFixture) partition(disk, name string, attrs map[string]string) {
+	f.t.Helper()
+	dir := filepath.Join(f.dirs[disk], name)
+	f.mkdir(filepath.Join(dir, "holders"))
+	f.write(dir, map[string]string{"partition": "1"})
+	f.write(dir, attrs)
+	f.link(name, dir)
+}
+
+// holder makes holder (e.g. "dm-0") hold the device name.
+func (f *sysfsFixture) holder(name, holder string) {
+	f.t.Helper()
+	f.mkdir(filepath.Join(f.dirs[name], "holders", holder))
+}
+
+// sectors returns size in the 512-byte units of the sysfs size attribute.
+func sectors(size int64) string {
+	return strconv.FormatInt(size/512, 10)
+}
+
+func TestDeviceGuardCheck(t *testing.T) {
+	f := newSysfsFixture(t)
+	// A USB stick with a mounted partition.
+	f.disk("pci0/usb1/1-1/host6", "sdx", map[string]string{"removable": "1", "size": sectors(8 << 30)})
+	f.partition("sdx", "sdx1", map[string]string{"size": sectors(8<<30 - 1<<20)})
+	// A card whose partition is held by dm-crypt.
+	f.disk("pci0/mmc0", "mmcblk9", map[string]string{"removable": "0", "size": sectors(16 << 30)})
+	f.partition("mmcblk9", "mmcblk9p1", map[string]string{"size": sectors(16 << 30)})
+	f.holder("mmcblk9p1", "dm-7")
+	// A 2 TB internal disk with a small first partition.
+	f.disk("pci0/ata1/host0", "sdy", map[string]string{"removable": "0", "size": sectors(2 << 40)})
+	f.partition("sdy", "sdy1", map[string]string{"size": sectors(512 << 20)})
+	// An internal disk whose removable attribute is missing.
+	f.disk("pci0/nvme0", "nvme9n1", map[string]string{"size": sectors(1 << 40)})
+	// A small fixed disk and a large removable one.
+	f.disk("pci0/ata2/host1", "sdz", map[string]string{"removable": "0", "size": sectors(4 << 30)})
+	f.disk("pci0/usb2/2-1/host7", "sdw", map[string]string{"removable": "1", "size": sectors(1 << 40)})
+
+	mounts := filepath.Join(t.TempDir(), "mounts")
+	err := os.WriteFile(mounts, []byte(
+		"proc /proc proc rw 0 0\n"+
+			"/dev/sdx1 /media/my\\040stick vfat rw 0 0\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		set    func(g *deviceGuard)
+		want   string // part of the error, "" for none
+	}{
+		{"mounted partition", "sdx", nil, "/dev/sdx1 is mounted on /media/my stick"},
+		{"mounted partition itself", "sdx1", nil, "mounted"},
+		{"allow mounted", "sdx", func(g *deviceGuard) { g.AllowMounted = true }, ""},
+		{"held partition", "mmcblk9", nil, "/dev/mmcblk9p1 is in use by dm-7"},
+		{"held device", "mmcblk9p1", nil, "in use by dm-7"},
+		{"allow in use", "mmcblk9", func(g *deviceGuard) { g.AllowInUse = true }, ""},
+		{"large fixed disk", "sdy", nil, "--allow-fixed"},
+		{"partition of large fixed disk", "sdy1", nil, "--allow-fixed"},
+		{"missing removable attribute", "nvme9n1", nil, "--allow-fixed"},
+		{"allow fixed", "sdy1", func(g *deviceGuard) { g.AllowFixed = true }, ""},
+		{"raised max fixed size", "sdy", func(g *deviceGuard) { g.MaxFixed = 4 << 40 }, ""},
+		{"small fixed disk", "sdz", nil, ""},
+		{"large removable disk", "sdw", nil, ""},
+		{"not in sysfs", "disk.img", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newDeviceGuard()
+			g.SysfsRoot, g.MountsFile = f.root, mounts
+			if tt.set != nil {
+				tt.set(g)
+			}
+			// The device path does not exist, so only its name is used.
+			err := g.check(filepath.Join(t.TempDir(), tt.device))
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("check: %v, want no error", err)
+			case tt.want != "" && err == nil:
+				t.Errorf("check: no error, want one containing %q", tt.want)
+			case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+				t.Errorf("check: %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceGuardCheckInUse(t *testing.T) {
+	f := newSysfsFixture(t)
+	f.disk("pci0/usb1/1-1/host6", "sdx", map[string]string{"removable": "1", "size": sectors(8 << 30)})
+	f.partition("sdx", "sdx1", map[string]string{"size": sectors(8<<30 - 1<<20)})
+	f.disk("pci0/mmc0", "mmcblk9", map[string]string{"removable": "0", "size": sectors(16 << 30)})
+	f.holder("mmcblk9", "dm-7")
+	f.disk("pci0/ata1/host0", "sdy", map[string]string{"removable": "0", "size": sectors(2 << 40)})
+
+	mounts := filepath.Join(t.TempDir(), "mounts")
+	if err := os.WriteFile(mounts, []byte("/dev/sdx1 /mnt vfat rw 0 0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		device string
+		set    func(g *deviceGuard)
+		want   string // part of the error, "" for none
+	}{
+		{"mounted", "sdx1", nil, "--allow-mounted"},
+		{"allow mounted", "sdx1", func(g *deviceGuard) { g.AllowMounted = true }, ""},
+		{"held", "mmcblk9", nil, "--allow-in-use"},
+		{"allow in use", "mmcblk9", func(g *deviceGuard) { g.AllowInUse = true }, ""},
+		{"large fixed disk", "sdy", nil, ""}, // only whole-device writes check the size
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newDeviceGuard()
+			g.SysfsRoot, g.MountsFile = f.root, mounts
+			if tt.set != nil {
+				tt.set(g)
+			}
+			err := g.checkInUse(filepath.Join(t.TempDir(), tt.device))
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("checkInUse: %v, want no error", err)
+			case tt.want != "" && err == nil:
+				t.Errorf("checkInUse: no error, want one containing %q", tt.want)
+			case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+				t.Errorf("checkInUse: %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
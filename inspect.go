@@ -0,0 +1,313 @@
+// inspect.go
+// inspect: read the boot sector of an existing image, device or partition
+// and report its geometry and layout, without trusting or loading the FAT.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+/* ===================== MBR ===================== */
+
+// mbrPartition is a primary partition entry of a master boot record.
+type mbrPartition struct {
+	Index    int    `json:"index"` // 1-4
+	Type     string `json:"type"`  // partition type byte, e.g. "0x0C"
+	Bootable bool   `json:"bootable"`
+	Start    int64  `json:"start"`   // first sector
+	Sectors  int64  `json:"sectors"` // length in sectors
+}
+
+// mbrGPTProtective is the partition type of the protective MBR of a GPT
+// disk.
+const mbrGPTProtective = 0xEE
+
+// parseMBR returns the used primary partitions of sec, or nil when sec is
+// not a plausible master boot record.
+func parseMBR(sec []byte) []mbrPartition {
+	if len(sec) < 512 || sec[510] != 0x55 || sec[511] != 0xAA {
+		return nil
+	}
+	var parts []mbrPartition
+	for i := 0; i < 4; i++ {
+		e := sec[446+16*i : 446+16*(i+1)]
+		if e[0] != 0 && e[0] != 0x80 {
+			return nil // status must be 0x00 or 0x80
+		}
+		if e[4] == 0 {
+			continue
+		}
+		parts = append(parts, mbrPartition{
+			Index:    i + 1,
+			Type:     fmt.Sprintf("0x%02X", e[4]),
+			Bootable: e[0] == 0x80,
+			Start:    int64(binary.LittleEndian.Uint32(e[8:])),
+			Sectors:  int64(binary.LittleEndian.Uint32(e[12:])),
+		})
+	}
+	return parts
+}
+
+/* ===================== Inspection ===================== */
+
+// bootRecord holds the boot sector fields that are not part of geom.
+type bootRecord struct {
+	Signature  bool   `json:"signature"`    // 55AA at offset 510
+	Jump       string `json:"jump"`         // first three bytes, hex
+	ExtBootSig string `json:"ext_boot_sig"` // 0x29 (or 0x28) when the extended BPB is valid
+	DriveNum   string `json:"drive_num"`
+	FSType     string `json:"fs_type"` // informational only; the cluster count decides
+}
+
+// inspectVolume reads the boot sector at the start of r, which holds size
+// bytes (0 if unknown), and reports the volume it describes together with
+// the inconsistencies it finds. FAT and directories are not read, so a
+// volume too damaged to open still inspects.
+func inspectVolume(r io.ReaderAt, size int64, target string, part *mbrPartition) (*volumeReport, *fatVolume, error) {
+	sec := make([]byte, 512)
+	if _, err := r.ReadAt(sec, 0); err != nil {
+		return nil, nil, fmt.Errorf("read boot sector: %w", err)
+	}
+	v, err := parseBootSector(sec)
+	if err != nil {
+		return nil, nil, err
+	}
+	g := v.g
+	bps := v.bps()
+	total := int64(v.totalSectors())
+
+	rep := newVolumeReport("inspect", target, v.ft, total*bps, g, v.fatSecs, v.rootSecs, v.dataSecs, v.clusters, v.label, v.oem, v.serial)
+	rep.Partition = part
+
+	ext := 36
+	if v.ft == FAT32 {
+		ext = 64
+	}
+	boot := &bootRecord{
+		Signature:  sec[510] == 0x55 && sec[511] == 0xAA,
+		Jump:       fmt.Sprintf("%02X %02X %02X", sec[0], sec[1], sec[2]),
+		ExtBootSig: fmt.Sprintf("0x%02X", sec[ext+2]),
+		DriveNum:   fmt.Sprintf("0x%02X", sec[ext]),
+	}
+	if sec[ext+2] == 0x29 {
+		boot.FSType = strings.TrimRight(string(sec[ext+18:ext+26]), " \x00")
+	}
+	rep.Boot = boot
+
+	c := &checker{v: v, size: size}
+	c.rep.Issues = []checkIssue{}
+	if !boot.Signature {
+		c.add(sevWarning, "boot-signature", "", 0, "boot sector signature is %02X%02X, expected 55AA", sec[510], sec[511])
+	}
+	if !(sec[0] == 0xEB && sec[2] == 0x90) && sec[0] != 0xE9 {
+		c.add(sevWarning, "jump", "", 0, "boot sector does not start with a jump instruction (%s)", boot.Jump)
+	}
+	if g.Media != 0xF0 && g.Media < 0xF8 {
+		c.add(sevError, "media", "", 0, "invalid media descriptor 0x%02X", g.Media)
+	}
+	switch {
+	case g.TotalSectors16 != 0 && g.TotalSectors32 != 0 && uint32(g.TotalSectors16) != g.TotalSectors32:
+		c.add(sevWarning, "total-sectors", "", 0, "both total sector fields are set and differ (%d and %d)", g.TotalSectors16, g.TotalSectors32)
+	case g.TotalSectors16 == 0 && g.TotalSectors32 < 0x10000 && v.ft != FAT32:
+		c.add(sevInfo, "total-sectors", "", 0, "%d sectors stored in the 32-bit field, the 16-bit one would do", g.TotalSectors32)
+	}
+	if size > 0 {
+		switch need := total * bps; {
+		case need > size:
+			c.add(sevError, "total-sectors", "", 0, "BPB declares %d sectors (%s) but the target holds only %s", total, human(need), human(size))
+		case need < size:
+			c.add(sevInfo, "total-sectors", "", 0, "BPB declares %d sectors (%s); the last %s of the target are unused", total, human(need), human(size-need))
+		}
+	}
+	if part != nil {
+		if int64(g.HiddenSectors) != part.Start {
+			c.add(sevWarning, "hidden-sectors", "", 0, "hidden sectors is %d but the partition starts at sector %d", g.HiddenSectors, part.Start)
+		}
+	}
+	if boot.FSType != "" && strings.HasPrefix(boot.FSType, "FAT") && boot.FSType != "FAT" && boot.FSType != rep.Type {
+		c.add(sevWarning, "fs-type", "", 0, "extended BPB says %s but %d clusters make it %s", boot.FSType, v.clusters, rep.Type)
+	}
+	if (uint32(g.RootEntries)*32)%uint32(g.BytesPerSector) != 0 {
+		c.add(sevWarning, "root-entries", "", 0, "root entry count %d does not fill whole sectors", g.RootEntries)
+	}
+	if g.SectorsPerTrack == 0 || g.NumHeads == 0 {
+		c.add(sevInfo, "chs", "", 0, "no CHS geometry (sectors/track %d, heads %d)", g.SectorsPerTrack, g.NumHeads)
+	}
+
+	// Compare the FAT size with what computeLayout derives for this geometry.
+	lg := g
+	if v.ft == FAT32 {
+		lg.SectorsPerFAT32 = v.fatSecs
+	}
+	fatSecs, _, _, _, err := computeLayout(v.ft, &lg)
+	switch {
+	case err != nil:
+		c.add(sevWarning, "layout", "", 0, "geometry does not satisfy FAT%d layout rules: %v", v.ft, err)
+	case fatSecs > v.fatSecs:
+		c.add(sevError, "fat-size", "", 0, "sectors/FAT is %d, layout needs %d", v.fatSecs, fatSecs)
+	case fatSecs < v.fatSecs:
+		c.add(sevInfo, "fat-size", "", 0, "sectors/FAT is %d, %d would do", v.fatSecs, fatSecs)
+	}
+
+	if v.ft == FAT32 {
+		if !v.validCluster(g.RootCluster) {
+			c.add(sevError, "root-cluster", "", 0, "root cluster %d is out of range", g.RootCluster)
+		}
+		if g.FSInfoSector == 0 || g.FSInfoSector >= g.ReservedSectors {
+			c.add(sevWarning, "fsinfo-sector", "", 0, "FSInfo sector %d is outside the reserved area", g.FSInfoSector)
+		}
+		if bb := g.BackupBootSector; bb != 0 && bb < g.ReservedSectors {
+			backup := make([]byte, 512)
+			if _, err := r.ReadAt(backup, int64(bb)*bps); err == nil && !bytes.Equal(sec, backup) {
+				c.add(sevWarning, "backup-boot", "", 0, "backup boot sector %d differs from sector 0", bb)
+			}
+		}
+	}
+	rep.Issues = c.rep.Issues
+	return rep, v, nil
+}
+
+// printInspectReport prints the volume v the way format prints a new one,
+// plus the boot record and the issues from rep.
+func printInspectReport(rep *volumeReport, v *fatVolume) {
+	fmt.Printf("Inspecting %s", rep.Target)
+	if p := rep.Partition; p != nil {
+		fmt.Printf(", partition %d (type %s, sectors %d-%d)", p.Index, p.Type, p.Start, p.Start+p.Sectors-1)
+	}
+	fmt.Println()
+	fmt.Printf("%s: %d clusters (FAT12 below 4085, FAT16 below 65525)\n\n", rep.Type, v.clusters)
+	printGeometryInfo(v.ft, rep.Bytes, v.g, v.fatSecs, v.rootSecs, v.dataSecs, v.clusters, v.label, v.oem, v.serial)
+
+	b := rep.Boot
+	fs := b.FSType
+	if fs == "" {
+		fs = "-"
+	}
+	fmt.Printf("Boot record: jump %s, signature %t, extended BPB %s, drive %s, type %s\n",
+		b.Jump, b.Signature, b.ExtBootSig, b.DriveNum, fs)
+	if len(rep.Issues) == 0 {
+		fmt.Println("\nNo inconsistencies found.")
+		return
+	}
+	fmt.Println()
+	for _, is := range rep.Issues {
+		fmt.Printf("  %-7s %-16s %s\n", strings.ToUpper(is.Severity), is.Code, is.Message)
+	}
+}
+
+func newInspectCmd() *cobra.Command {
+	var output string
+	var partition int
+	cmd := &cobra.Command{
+		Use:   "inspect <image|device>",
+		Short: "Show the geometry and layout of an existing FAT volume",
+		Long: "Parse the BPB and extended BPB of an image, device or partition and show\n" +
+			"the same geometry and layout block format prints, the FAT type by the\n" +
+			"Microsoft cluster-count rule, and any inconsistencies in the BPB. A disk\n" +
+			"with an MBR is looked into: the FAT partition is inspected if there is\n" +
+			"only one, else choose it with --partition.\n\n" +
+			"Exit status: 0 no errors, 4 inconsistencies of error severity, 2 the\n" +
+			"target could not be inspected.",
+		Args:          cobra.ExactArgs(1),
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		RunE: func(_ *cobra.Command, args []string) error {
+			if err := checkOutputFormat(output); err != nil {
+				return err
+			}
+			if partition < 0 || partition > 4 {
+				return fmt.Errorf("--partition must be 1-4")
+			}
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			size, _ := getDeviceSize(f)
+
+			sec := make([]byte, 512)
+			if _, err := f.ReadAt(sec, 0); err != nil {
+				return fmt.Errorf("%s: read sector 0: %w", args[0], err)
+			}
+			var r io.ReaderAt = f
+			var part *mbrPartition
+			if _, err := parseBootSector(sec); err != nil || partition > 0 {
+				part, err = pickPartition(sec, partition, err)
+				if err != nil {
+					return fmt.Errorf("%s: %w", args[0], err)
+				}
+				r = io.NewSectionReader(f, part.Start*512, part.Sectors*512)
+				size = part.Sectors * 512
+			}
+
+			rep, v, err := inspectVolume(r, size, args[0], part)
+			if err != nil {
+				return fmt.Errorf("%s: %w", args[0], err)
+			}
+			if output == "text" {
+				printInspectReport(rep, v)
+			} else if err := writeStructured(os.Stdout, rep, output); err != nil {
+				return err
+			}
+			for _, is := range rep.Issues {
+				if is.Severity == sevError {
+					return &exitCodeError{code: checkExitErrors}
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&output, "output", "text", "report format: text|json|yaml")
+	cmd.Flags().IntVar(&partition, "partition", 0, "MBR partition to inspect (1-4; default: the only FAT one)")
+	return cmd
+}
+
+// fatPartitionTypes are the MBR types used for FAT volumes.
+var fatPartitionTypes = map[string]bool{
+	"0x01": true, "0x04": true, "0x06": true, "0x0B": true, "0x0C": true, "0x0E": true,
+}
+
+// pickPartition chooses the partition to inspect from the MBR in sec:
+// number n, or with n 0 the only FAT partition. bootErr says why sector 0
+// is not a FAT boot sector itself.
+func pickPartition(sec []byte, n int, bootErr error) (*mbrPartition, error) {
+	parts := parseMBR(sec)
+	if parts == nil {
+		if n > 0 {
+			return nil, errors.New("no MBR partition table")
+		}
+		return nil, bootErr
+	}
+	if n > 0 {
+		for i := range parts {
+			if parts[i].Index == n {
+				return &parts[i], nil
+			}
+		}
+		return nil, fmt.Errorf("partition %d is empty", n)
+	}
+	var fat []mbrPartition
+	for _, p := range parts {
+		if p.Type == fmt.Sprintf("0x%02X", mbrGPTProtective) {
+			return nil, errors.New("GPT disk: inspect the partition device instead")
+		}
+		if fatPartitionTypes[p.Type] {
+			fat = append(fat, p)
+		}
+	}
+	switch len(fat) {
+	case 0:
+		return nil, errors.New("MBR has no FAT partition (use --partition to inspect one anyway)")
+	case 1:
+		return &fat[0], nil
+	}
+	return nil, fmt.Errorf("MBR has %d FAT partitions, choose one with --partition", len(fat))
+}
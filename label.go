@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+/* ===================== label ===================== */
+
+// normalizeLabel upper-cases a volume label and checks it against the DOS
+// rules: at most 11 characters, the 8.3 name characters plus spaces.
+func normalizeLabel(label string) (string, error) {
+	label = strings.TrimRight(strings.ToUpper(label), " ")
+	if len(label) > 11 {
+		return "", fmt.Errorf("label %q is longer than 11 characters", label)
+	}
+	if strings.HasPrefix(label, " ") {
+		return "", fmt.Errorf("label %q cannot start with a space", label)
+	}
+	for _, r := range label {
+		if r != ' ' && !validShortChar(r) {
+			return "", fmt.Errorf("label %q contains %q, which DOS does not allow", label, r)
+		}
+	}
+	return label, nil
+}
+
+// bootLabelSectors returns the sectors holding a copy of the extended BPB:
+// the boot sector and, on FAT32, its backup.
+func (v *fatVolume) bootLabelSectors() []int64 {
+	secs := []int64{0}
+	if v.ft == FAT32 && v.g.BackupBootSector != 0 && v.g.BackupBootSector < v.g.ReservedSectors {
+		secs = append(secs, int64(v.g.BackupBootSector))
+	}
+	return secs
+}
+
+// setLabel stores label in the extended BPB of every boot sector copy and in
+// the root directory label entry, which is created if missing. An empty
+// label removes the entry and sets the BPB field to "NO NAME".
+func (v *fatVolume) setLabel(label string) error {
+	if v.w == nil {
+		return errors.New("volume is read-only")
+	}
+	ext := int64(36)
+	if v.ft == FAT32 {
+		ext = 64
+	}
+	field := padRight(label, 11)
+	if label == "" {
+		field = padRight("NO NAME", 11)
+	}
+	for _, s := range v.bootLabelSectors() {
+		sec := make([]byte, v.bps())
+		if _, err := v.r.ReadAt(sec, s*v.bps()); err != nil {
+			return fmt.Errorf("read boot sector %d: %w", s, err)
+		}
+		if sec[ext+2] != 0x29 {
+			continue // no extended BPB, so no label field
+		}
+		if _, err := v.w.WriteAt(field, s*v.bps()+ext+7); err != nil {
+			return fmt.Errorf("write boot sector %d: %w", s, err)
+		}
+	}
+	v.label = strings.TrimRight(string(field), " ")
+
+	d, err := v.readDir(0)
+	if err != nil {
+		return err
+	}
+	slot := -1
+	for _, e := range d.entries() {
+		if e.isLabel() {
+			slot = e.Slot
+			break
+		}
+	}
+	if label == "" {
+		if slot < 0 {
+			return nil
+		}
+		raw := append([]byte(nil), d.data[slot*32:slot*32+32]...)
+		raw[0] = 0xE5
+		return v.writeSlots(d, slot, raw)
+	}
+	if slot < 0 {
+		if slot, err = v.findFreeSlots(d, 1); err != nil {
+			return err
+		}
+	}
+	var short [11]byte
+	copy(short[:], field)
+	if err := v.writeSlots(d, slot, encodeDirEntry(short, attrVolumeID, 0, 0, now())); err != nil {
+		return err
+	}
+	return v.flush()
+}
+
+func printLabel(v *fatVolume) {
+	label := v.volumeLabel()
+	if label == "" {
+		fmt.Println(" Volume has no label")
+	} else {
+		fmt.Printf(" Volume label is %s\n", label)
+	}
+	if boot := v.label; boot != label && !(label == "" && boot == "NO NAME") {
+		fmt.Printf(" Boot sector label is %s\n", boot)
+	}
+	fmt.Printf(" Volume Serial Number is %04X-%04X\n", v.serial>>16, v.serial&0xFFFF)
+}
+
+func newLabelCmd() *cobra.Command {
+	var clear bool
+	guard := newDeviceGuard()
+	cmd := &cobra.Command{
+		Use:   "label <image|device> [NEWLABEL]",
+		Short: "Show or change the volume label of a FAT12/16/32 image or device",
+		Long: "Show the volume label and serial number, or change the label without\n" +
+			"reformatting. The boot sector (and the FAT32 backup boot sector) and the\n" +
+			"label entry in the root directory are updated together.",
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(_ *cobra.Command, args []string) (err error) {
+			change := len(args) == 2 || clear
+			if len(args) == 2 && clear {
+				return errors.New("give a new label or --clear, not both")
+			}
+			f, v, err := openVolumeFile(args[0], change, guard)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if !change {
+				printLabel(v)
+				return nil
+			}
+			label := ""
+			if !clear {
+				if label, err = normalizeLabel(args[1]); err != nil {
+					return err
+				}
+				if label == "" {
+					return errors.New("empty label; use --clear to remove the label")
+				}
+			}
+			audit := newVolumeAudit("label", args[0])
+			defer func() { audit.finish(err) }()
+			if err := v.setLabel(label); err != nil {
+				return err
+			}
+			if err := f.Sync(); err != nil {
+				return err
+			}
+			printLabel(v)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&clear, "clear", false, "remove the volume label")
+	guard.addInUseFlags(cmd)
+	return cmd
+}
@@ -0,0 +1,174 @@
+// lfn.go
+// VFAT long file names: LFN entry runs, the short-name checksum, UCS-2
+// names and "~N" short aliases, as introduced by Windows 95.
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// lfnCharOffsets are the byte offsets of the 13 UCS-2 characters in an LFN entry.
+var lfnCharOffsets = [13]int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30}
+
+// lfnChecksum is the checksum of an 11-byte short name stored in every LFN entry.
+func lfnChecksum(short [11]byte) byte {
+	var sum byte
+	for _, c := range short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+// lfnRun collects the LFN entries in front of a short entry. They are stored
+// highest sequence number first, so the name is assembled in reverse.
+type lfnRun struct {
+	parts map[int][]uint16 // 13 UCS-2 characters per sequence number
+	want  int              // sequence number expected next
+	total int              // number of LFN entries in the run
+	sum   byte             // checksum every entry must carry
+	start int              // slot of the first (highest sequence) entry
+}
+
+// add feeds one LFN entry at slot. An entry that does not continue the
+// current run discards it.
+func (r *lfnRun) add(raw []byte, slot int) {
+	seq := int(raw[0] & 0x1F)
+	if raw[0]&0x40 != 0 {
+		*r = lfnRun{parts: map[int][]uint16{}, want: seq, total: seq, sum: raw[13], start: slot}
+	}
+	if r.parts == nil || seq != r.want || raw[13] != r.sum || seq == 0 {
+		*r = lfnRun{}
+		return
+	}
+	u := make([]uint16, 0, 13)
+	for _, o := range lfnCharOffsets {
+		u = append(u, binary.LittleEndian.Uint16(raw[o:]))
+	}
+	r.parts[seq] = u
+	r.want--
+}
+
+// name returns the long name if the run is complete and matches short.
+func (r *lfnRun) name(short [11]byte) (string, bool) {
+	if r.parts == nil || r.want != 0 || r.sum != lfnChecksum(short) {
+		return "", false
+	}
+	units := []uint16{}
+	for seq := 1; seq <= r.total; seq++ {
+		for _, c := range r.parts[seq] {
+			if c == 0x0000 {
+				return string(utf16.Decode(units)), true
+			}
+			units = append(units, c)
+		}
+	}
+	return string(utf16.Decode(units)), true
+}
+
+// lfnInvalidChars cannot appear in a long name.
+const lfnInvalidChars = "\"*/:<>?\\|"
+
+// validLongName checks a name against the VFAT rules.
+func validLongName(name string) error {
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("%q is not a valid file name", name)
+	}
+	if len(utf16.Encode([]rune(name))) > 255 {
+		return fmt.Errorf("%q is longer than 255 characters", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune(lfnInvalidChars, r) {
+			return fmt.Errorf("%q contains %q, which FAT does not allow", name, r)
+		}
+	}
+	return nil
+}
+
+// needsLFN reports whether name cannot be stored exactly as an 8.3 name.
+func needsLFN(name string) bool {
+	if _, err := shortName(name); err != nil {
+		return true
+	}
+	return name != strings.ToUpper(name)
+}
+
+// shortAlias derives a unique 8.3 alias for a long name: the upper-cased
+// name itself when it fits, otherwise "BASE~N.EXT". taken reports whether a
+// candidate display name is already used.
+func shortAlias(name string, taken func(string) bool) ([11]byte, error) {
+	if s, err := shortName(name); err == nil && !taken(shortDisplayName(s, false)) {
+		return s, nil
+	}
+	clean := func(s string) string {
+		var b strings.Builder
+		for _, r := range strings.ToUpper(s) {
+			switch {
+			case r == ' ' || r == '.':
+			case r < 0x80 && validShortChar(r):
+				b.WriteRune(r)
+			default:
+				b.WriteByte('_')
+			}
+		}
+		return b.String()
+	}
+	trimmed := strings.TrimLeft(name, ".")
+	base, ext := trimmed, ""
+	if i := strings.LastIndexByte(trimmed, '.'); i > 0 {
+		base, ext = trimmed[:i], trimmed[i+1:]
+	}
+	base, ext = clean(base), clean(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if base == "" {
+		base = "_"
+	}
+	for n := 1; n < 1000000; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		b := base
+		if len(b)+len(tail) > 8 {
+			b = b[:8-len(tail)]
+		}
+		cand := b + tail
+		if ext != "" {
+			cand += "." + ext
+		}
+		if !taken(cand) {
+			return shortName(cand)
+		}
+	}
+	return [11]byte{}, fmt.Errorf("%q: no free short alias", name)
+}
+
+// encodeLFN builds the LFN entries (highest sequence first, as stored on
+// disk) that precede the short entry short for the long name name.
+func encodeLFN(name string, short [11]byte) []byte {
+	units := utf16.Encode([]rune(name))
+	n := (len(units) + 12) / 13
+	if len(units)%13 != 0 {
+		units = append(units, 0x0000)
+	}
+	for len(units) < n*13 {
+		units = append(units, 0xFFFF)
+	}
+	sum := lfnChecksum(short)
+	out := make([]byte, n*32)
+	for i := 0; i < n; i++ {
+		seq := n - i
+		e := out[i*32 : i*32+32]
+		e[0] = byte(seq)
+		if i == 0 {
+			e[0] |= 0x40
+		}
+		e[11] = attrLFN
+		e[13] = sum
+		for k, o := range lfnCharOffsets {
+			binary.LittleEndian.PutUint16(e[o:], units[(seq-1)*13+k])
+		}
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+/* ===================== ls / dir ===================== */
+
+// attrString renders attributes as a fixed-width "RHSVDA" style flag field.
+func attrString(a uint8) string {
+	flags := []struct {
+		bit uint8
+		ch  byte
+	}{
+		{attrReadOnly, 'R'}, {attrHidden, 'H'}, {attrSystem, 'S'},
+		{attrVolumeID, 'V'}, {attrDir, 'D'}, {attrArchive, 'A'},
+	}
+	b := make([]byte, len(flags))
+	for i, f := range flags {
+		b[i] = '-'
+		if a&f.bit != 0 {
+			b[i] = f.ch
+		}
+	}
+	return string(b)
+}
+
+func printListing(v *fatVolume, p string, entries []dirEntry) {
+	label := v.volumeLabel()
+	if label == "" {
+		fmt.Println(" Volume has no label")
+	} else {
+		fmt.Printf(" Volume label is %s\n", label)
+	}
+	fmt.Printf(" Volume Serial Number is %04X-%04X\n", v.serial>>16, v.serial&0xFFFF)
+	fmt.Printf(" Directory of ::/%s\n\n", strings.Join(splitFATPath(p), "/"))
+
+	files, bytes := 0, int64(0)
+	for _, e := range entries {
+		size := fmt.Sprintf("%10d", e.Size)
+		if e.isDir() {
+			size = fmt.Sprintf("%-10s", "<DIR>")
+		} else {
+			files++
+			bytes += int64(e.Size)
+		}
+		date := "                "
+		if !e.Mod.IsZero() {
+			date = e.Mod.Format("2006-01-02 15:04")
+		}
+		fmt.Printf("%-12s  %s  %s  %s  %8d  %s\n", e.shortName(), size, date, attrString(e.Attr), e.Cluster, e.Long)
+	}
+	free := int64(v.freeClusters()) * v.clusterBytes()
+	fmt.Printf("%9d file(s) %14d bytes\n", files, bytes)
+	fmt.Printf("%24d bytes free\n", free)
+}
+
+func newLsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "ls <image|device> [::/path]",
+		Aliases: []string{"dir"},
+		Short:   "List a directory of a FAT12/16/32 image or device (read-only)",
+		Args:    cobra.RangeArgs(1, 2),
+		RunE: func(_ *cobra.Command, args []string) error {
+			p := "::/"
+			if len(args) == 2 {
+				p = args[1]
+			}
+			f, v, err := openVolumeFile(args[0], false, nil)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			entries, err := v.listDir(p)
+			if err != nil {
+				return err
+			}
+			printListing(v, p, entries)
+			return nil
+		},
+	}
+}
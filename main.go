@@ -41,27 +41,52 @@ const (
 	FAT32 FATType = 32
 )
 
+// geom holds the BPB fields of a volume. The JSON names are part of the
+// volume report schema (see volumeReport).
 type geom struct {
-	BytesPerSector    uint16
-	SectorsPerCluster uint8
-	ReservedSectors   uint16
-	NumFATs           uint8
-	RootEntries       uint16
-	TotalSectors16    uint16
-	Media             uint8
-	SectorsPerFAT16   uint16
-	SectorsPerTrack   uint16
-	NumHeads          uint16
-	HiddenSectors     uint32
-	TotalSectors32    uint32
-	SectorsPerFAT32   uint32
-	RootCluster       uint32
-	FSInfoSector      uint16
-	BackupBootSector  uint16
+	BytesPerSector    uint16 `json:"bytes_per_sector"`
+	SectorsPerCluster uint8  `json:"sectors_per_cluster"`
+	ReservedSectors   uint16 `json:"reserved_sectors"`
+	NumFATs           uint8  `json:"num_fats"`
+	RootEntries       uint16 `json:"root_entries"`
+	TotalSectors16    uint16 `json:"total_sectors_16"`
+	Media             uint8  `json:"media"`
+	SectorsPerFAT16   uint16 `json:"sectors_per_fat_16"`
+	SectorsPerTrack   uint16 `json:"sectors_per_track"`
+	NumHeads          uint16 `json:"num_heads"`
+	HiddenSectors     uint32 `json:"hidden_sectors"`
+	TotalSectors32    uint32 `json:"total_sectors_32"`
+	SectorsPerFAT32   uint32 `json:"sectors_per_fat_32"`
+	RootCluster       uint32 `json:"root_cluster"`
+	FSInfoSector      uint16 `json:"fsinfo_sector"`
+	BackupBootSector  uint16 `json:"backup_boot_sector"`
 }
 
+// exitCodeError makes a command exit with a specific status, for commands
+// whose exit code carries meaning for scripts (e.g. check).
+type exitCodeError struct {
+	code int
+	err  error
+}
+
+func (e *exitCodeError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitCodeError) Unwrap() error { return e.err }
+
 func must(err error) {
 	if err != nil {
+		var ec *exitCodeError
+		if errors.As(err, &ec) {
+			if ec.err != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", ec.err)
+			}
+			os.Exit(ec.code)
+		}
 		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(2)
 	}
@@ -297,7 +322,7 @@ func computeLayout(ft FATType, g *geom) (fatSectors, rootDirSectors, dataSectors
 
 /* ===================== Boot/FAT builders ===================== */
 
-func buildBootSector1216(ft FATType, g geom, volLabel, oem string) []byte {
+func buildBootSector1216(ft FATType, g geom, volLabel, oem string, serial uint32) []byte {
 	if volLabel == "" {
 		volLabel = "NO NAME    "
 	}
@@ -320,7 +345,7 @@ func buildBootSector1216(ft FATType, g geom, volLabel, oem string) []byte {
 	binary.LittleEndian.PutUint32(sec[28:], g.HiddenSectors)
 	binary.LittleEndian.PutUint32(sec[32:], g.TotalSectors32)
 	sec[36], sec[37], sec[38] = 0x00, 0x00, 0x29
-	binary.LittleEndian.PutUint32(sec[39:], 0x12345678)
+	binary.LittleEndian.PutUint32(sec[39:], serial)
 	copy(sec[43:54], padRight(volLabel, 11))
 	if ft == FAT12 {
 		copy(sec[54:62], []byte("FAT12   "))
@@ -358,7 +383,7 @@ func buildBootSector1216(ft FATType, g geom, volLabel, oem string) []byte {
 	return sec
 }
 
-func buildBootSector32(g geom, volLabel, oem string) []byte {
+func buildBootSector32(g geom, volLabel, oem string, serial uint32) []byte {
 	if volLabel == "" {
 		volLabel = "NO NAME    "
 	}
@@ -389,7 +414,7 @@ func buildBootSector32(g geom, volLabel, oem string) []byte {
 	binary.LittleEndian.PutUint16(sec[48:], g.FSInfoSector)
 	binary.LittleEndian.PutUint16(sec[50:], g.BackupBootSector)
 	sec[64], sec[65], sec[66] = 0x80, 0x00, 0x29
-	binary.LittleEndian.PutUint32(sec[67:], 0x12345678)
+	binary.LittleEndian.PutUint32(sec[67:], serial)
 	copy(sec[71:82], padRight(volLabel, 11))
 	copy(sec[82:90], []byte("FAT32   "))
 
@@ -423,16 +448,37 @@ func buildBootSector32(g geom, volLabel, oem string) []byte {
 	return sec
 }
 
-func buildFSInfo() []byte {
+// buildFSInfo builds the FAT32 FSInfo sector with the given free-cluster
+// count and next-free hint.
+func buildFSInfo(free, next uint32) []byte {
 	fs := make([]byte, 512)
 	binary.LittleEndian.PutUint32(fs[0:], 0x41615252)
 	binary.LittleEndian.PutUint32(fs[484:], 0x61417272)
-	binary.LittleEndian.PutUint32(fs[488:], 0xFFFFFFFF)
-	binary.LittleEndian.PutUint32(fs[492:], 0x00000002)
+	binary.LittleEndian.PutUint32(fs[488:], free)
+	binary.LittleEndian.PutUint32(fs[492:], next)
 	binary.LittleEndian.PutUint32(fs[508:], 0xAA550000)
 	return fs
 }
 
+// buildReservedFAT32 builds the whole FAT32 reserved area: the three-sector
+// boot region (boot sector, FSInfo and a signed spare sector) and its backup
+// at BackupBootSector. A fresh volume has every cluster but the root free,
+// and the next free cluster is the one after the root.
+func buildReservedFAT32(g geom, boot []byte, clusters uint32) []byte {
+	res := make([]byte, int(g.ReservedSectors)*512)
+	copy(res, boot)
+	copy(res[int(g.FSInfoSector)*512:], buildFSInfo(clusters-1, g.RootCluster+1))
+	res[2*512+510], res[2*512+511] = 0x55, 0xAA
+	if bb := int(g.BackupBootSector); bb != 0 && bb+3 <= int(g.ReservedSectors) {
+		copy(res[bb*512:], res[:3*512])
+	}
+	return res
+}
+
+// buildRootLabelEntry builds the volume-label directory entry from a label
+// already passed through normalizeLabel. It has attribute 0x08 alone, so
+// LFN-aware readers (which look for attribute 0x0F) never mistake it for
+// part of a long name.
 func buildRootLabelEntry(label string) []byte {
 	if label == "" {
 		return nil
@@ -460,6 +506,8 @@ func initFAT1216(ft FATType, b []byte, media byte) {
 	}
 }
 
+// initFAT32 sets the media entry, FAT[1] (end of chain with the
+// clean-shutdown and no-error bits set) and the root directory chain.
 func initFAT32(b []byte, media byte) {
 	put := func(i int, v uint32) {
 		o := i * 4
@@ -480,6 +528,11 @@ type progressTracker struct {
 	progressMap  []bool
 	totalSectors int64
 	currentPos   int64
+	written      int64
+
+	every     int64             // sectors between status updates (--ui-every)
+	lastShown int64             // written count at the last status update
+	report    *progressReporter // headless progress output, if any
 }
 
 func newProgressTracker(total int64) *progressTracker {
@@ -495,8 +548,9 @@ func (pt *progressTracker) markRange(start int64, count int64) {
 		end = pt.totalSectors
 	}
 	for i := start; i < end; i++ {
-		if i >= 0 && i < int64(len(pt.progressMap)) {
+		if i >= 0 && i < int64(len(pt.progressMap)) && !pt.progressMap[i] {
 			pt.progressMap[i] = true
+			pt.written++
 		}
 	}
 	if end-1 >= 0 {
@@ -505,13 +559,17 @@ func (pt *progressTracker) markRange(start int64, count int64) {
 }
 
 func (pt *progressTracker) writtenCount() int64 {
-	count := int64(0)
-	for _, written := range pt.progressMap {
-		if written {
-			count++
-		}
+	return pt.written
+}
+
+// due reports whether at least every sectors were written since the last
+// status update, and if so starts the next interval.
+func (pt *progressTracker) due() bool {
+	if pt.written-pt.lastShown < pt.every {
+		return false
 	}
-	return count
+	pt.lastShown = pt.written
+	return true
 }
 
 // updateProgressMapVisualization generates visual progress map from tracker and updates UI.
@@ -608,13 +666,15 @@ func updateStatusLines(ui *retrodfrg.UI, pt *progressTracker, startTime time.Tim
 	}
 
 	var etaStr string
+	var eta time.Duration
 	if rate > 0 {
 		remainBytes := (totalSectors - written) * 512
-		eta := time.Duration(float64(remainBytes) / rate * float64(time.Second)).Truncate(time.Second)
+		eta = time.Duration(float64(remainBytes) / rate * float64(time.Second)).Truncate(time.Second)
 		etaStr = eta.String()
 	} else {
 		etaStr = "—"
 	}
+	pt.report.progress(currentOp, written, rate, eta)
 
 	mode := "REAL"
 	if isEmulate {
@@ -634,9 +694,8 @@ func updateStatusLines(ui *retrodfrg.UI, pt *progressTracker, startTime time.Tim
 
 // writeSpanWithStatus writes a buffer and updates status lines periodically.
 func writeSpanWithStatus(w io.WriterAt, absStart int64, buf []byte, ui *retrodfrg.UI, pt *progressTracker, currentOp string, startTime time.Time, emuRate float64, isEmulate bool, systemRanges [][2]int64) error {
-	const chunk = 1 << 20
+	chunk := chunkFor(w, 1<<20)
 	wr := int64(0)
-	updateCount := 0
 	for wr < int64(len(buf)) {
 		n := int64(len(buf)) - wr
 		if n > chunk {
@@ -654,12 +713,11 @@ func writeSpanWithStatus(w io.WriterAt, absStart int64, buf []byte, ui *retrodfr
 			return retrodfrg.ErrInterrupted
 		}
 		// Update status periodically or on first/last chunk
-		if currentOp != "" && (wr == 0 || updateCount%5 == 0 || wr+n >= int64(len(buf))) {
+		if currentOp != "" && (wr == 0 || pt.due() || wr+n >= int64(len(buf))) {
 			updateStatusLines(ui, pt, startTime, currentOp, emuRate, isEmulate, systemRanges)
 		}
 		ui.LayoutAndDraw()
 		wr += n
-		updateCount++
 	}
 	if currentOp != "" {
 		updateStatusLines(ui, pt, startTime, currentOp, emuRate, isEmulate, systemRanges)
@@ -670,11 +728,10 @@ func writeSpanWithStatus(w io.WriterAt, absStart int64, buf []byte, ui *retrodfr
 
 // zeroSpanWithStatus writes zeroes and updates status lines periodically.
 func zeroSpanWithStatus(w io.WriterAt, absStart, sectors int64, ui *retrodfrg.UI, pt *progressTracker, currentOp string, startTime time.Time, emuRate float64, isEmulate bool, systemRanges [][2]int64) error {
-	const zSize = 1 << 20
+	zSize := chunkFor(w, 1<<20)
 	z := make([]byte, zSize)
 	written := int64(0)
 	bytes := sectors * 512
-	updateCount := 0
 	for written < bytes {
 		k := bytes - written
 		if k > zSize {
@@ -692,12 +749,11 @@ func zeroSpanWithStatus(w io.WriterAt, absStart, sectors int64, ui *retrodfrg.UI
 			return retrodfrg.ErrInterrupted
 		}
 		// Update status periodically or on first/last chunk
-		if currentOp != "" && (written == 0 || updateCount%5 == 0 || written+k >= bytes) {
+		if currentOp != "" && (written == 0 || pt.due() || written+k >= bytes) {
 			updateStatusLines(ui, pt, startTime, currentOp, emuRate, isEmulate, systemRanges)
 		}
 		ui.LayoutAndDraw()
 		written += k
-		updateCount++
 	}
 	if currentOp != "" {
 		updateStatusLines(ui, pt, startTime, currentOp, emuRate, isEmulate, systemRanges)
@@ -718,20 +774,6 @@ func waitWithStop(ui *retrodfrg.UI) error {
 
 /* ===================== Emulation pacing ===================== */
 
-func defaultEmuBPS(size int64) float64 {
-	// Realistic floppy speeds based on actual hardware
-	switch size {
-	case 360 * 1024, 720 * 1024:
-		return 31.25 * 1024 // DD: 250 kbit/s → ~12s for 360K, ~23s for 720K
-	case 1200 * 1024, 1440 * 1024:
-		return 62.5 * 1024 // HD: 500 kbit/s → ~19s for 1.2M, ~23s for 1.44M
-	case 2880 * 1024:
-		return 125 * 1024 // ED: 1 Mbit/s → ~23s for 2.88M
-	default:
-		return 62.5 * 1024 // default: HD speed
-	}
-}
-
 // nullWriter implements writerAt but doesn't actually write anything
 type nullWriter struct{}
 
@@ -774,14 +816,19 @@ func checkBadSector(rw interface {
 		}
 	}
 
+	// Leave the sector zeroed, as a full format promises
+	if _, err := rw.WriteAt(make([]byte, 512), offset); err != nil {
+		return fmt.Errorf("bad sector %d (write failed): %w", sector, err)
+	}
 	return nil
 }
 
-// fullFormatDataArea zeros all data sectors with bad sector detection
+// fullFormatDataArea zeros all data sectors with bad sector detection and
+// returns the sectors that failed.
 func fullFormatDataArea(rw interface {
 	WriteAt([]byte, int64) (int, error)
 	ReadAt([]byte, int64) (int, error)
-}, absStart, sectors int64, u *retrodfrg.UI, pt *progressTracker, currentOp string, startTime time.Time, systemRanges [][2]int64) error {
+}, absStart, sectors int64, u *retrodfrg.UI, pt *progressTracker, currentOp string, startTime time.Time, systemRanges [][2]int64) ([]int64, error) {
 	const zSize = 1 << 20
 	z := make([]byte, zSize)
 	written := int64(0)
@@ -796,7 +843,7 @@ func fullFormatDataArea(rw interface {
 
 		// Write zeros
 		if _, err := rw.WriteAt(z[:k], (absStart*512)+written); err != nil {
-			return err
+			return badSectors, err
 		}
 
 		// Update UI and check sectors
@@ -806,7 +853,7 @@ func fullFormatDataArea(rw interface {
 		}
 		for i := int64(0); i < secs; i++ {
 			if u.IsStopped() {
-				return retrodfrg.ErrInterrupted
+				return badSectors, retrodfrg.ErrInterrupted
 			}
 
 			currentSector := absStart + written/512 + i
@@ -815,34 +862,34 @@ func fullFormatDataArea(rw interface {
 			if true {
 				if err := checkBadSector(rw, currentSector); err != nil {
 					badSectors = append(badSectors, currentSector)
+					pt.report.badSector(currentSector)
 					// Continue formatting but track bad sectors
 				}
 			}
 
 			pt.markRange(currentSector, 1)
-			// Update status every 10 sectors
-			if i%10 == 0 || i == secs-1 {
+			// Update status every --ui-every sectors
+			if pt.due() || i == secs-1 {
 				updateStatusLines(u, pt, startTime, currentOp, 0, false, systemRanges)
+				u.LayoutAndDraw()
 			}
-			u.LayoutAndDraw()
 		}
 		written += k
 	}
 
-	if len(badSectors) > 0 {
-		return fmt.Errorf("found %d bad sector(s): %v", len(badSectors), badSectors)
-	}
-
-	return nil
+	return badSectors, nil
 }
 
 // old eventLoop removed; handled inside retrodfrg.UI
 
 /* ===================== Main ===================== */
 
-func printGeometryInfo(ft FATType, sz int64, g geom, fatSecs, rootSecs, dataSecs, _ uint32, label, oem string) {
-	totalSectors := int64(sz / 512)
-	cylinders := int(totalSectors) / int(g.SectorsPerTrack) / int(g.NumHeads)
+func printGeometryInfo(ft FATType, sz int64, g geom, fatSecs, rootSecs, dataSecs, _ uint32, label, oem string, serial uint32) {
+	totalSectors := sz / int64(g.BytesPerSector)
+	cylinders := 0
+	if g.SectorsPerTrack > 0 && g.NumHeads > 0 {
+		cylinders = int(totalSectors) / int(g.SectorsPerTrack) / int(g.NumHeads)
+	}
 
 	absStartFAT1 := int64(g.ReservedSectors)
 	absStartFAT2 := absStartFAT1 + int64(fatSecs)
@@ -890,7 +937,7 @@ func printGeometryInfo(ft FATType, sz int64, g geom, fatSecs, rootSecs, dataSecs
 		fmt.Sprintf(" Reserved: %-4d    FATs: %-2d  Root entries: %d", g.ReservedSectors, g.NumFATs, g.RootEntries),
 		fmt.Sprintf(" Sectors/FAT: %-5d   RootDir sectors: %-5d   Data sectors: %d", fatSecs, rootSecs, dataSecs),
 		fmt.Sprintf(" Cluster size: %d sector%s (%d bytes)  Total sectors: %d", g.SectorsPerCluster, plural, clusterBytes, totalSectors),
-		fmt.Sprintf(" OEM: %s  Label: %s", oemDisplay, labelDisplay),
+		fmt.Sprintf(" OEM: %s  Label: %s  Serial: %04X-%04X", oemDisplay, labelDisplay, serial>>16, serial&0xFFFF),
 		barLight,
 		" LAYOUT (absolute sector ranges)",
 		barLight,
@@ -913,6 +960,18 @@ func printGeometryInfo(ft FATType, sz int64, g geom, fatSecs, rootSecs, dataSecs
 	fmt.Println()
 }
 
+// printDiskSummary prints the closing report the way DOS FORMAT did.
+func printDiskSummary(clusters, badClusters, freeClusters uint32, clusterBytes int64, serial uint32) {
+	fmt.Printf("%14d bytes total disk space\n", int64(clusters)*clusterBytes)
+	if badClusters > 0 {
+		fmt.Printf("%14d bytes in bad sectors\n", int64(badClusters)*clusterBytes)
+	}
+	fmt.Printf("%14d bytes available on disk\n\n", int64(freeClusters)*clusterBytes)
+	fmt.Printf("%14d bytes in each allocation unit\n", clusterBytes)
+	fmt.Printf("%14d allocation units available on disk\n\n", freeClusters)
+	fmt.Printf("Volume Serial Number is %04X-%04X\n", serial>>16, serial&0xFFFF)
+}
+
 /* ===================== Copy operations ===================== */
 
 func copyDeviceToImage(devicePath, imagePath string, blockSize int64) error {
@@ -1043,27 +1102,46 @@ func copyImageToDevice(imagePath, devicePath string, blockSize int64) error {
 }
 
 func main() {
+	var seed string
 	root := &cobra.Command{
 		Use:   "mkfat",
 		Short: "FAT filesystem formatter and disk imaging utility",
-		Long:  "Create FAT12/16/32 filesystems on images or devices, and copy disk images",
+		Long: "Create FAT12/16/32 filesystems on images or devices, and copy disk images.\n\n" +
+			"Setting SOURCE_DATE_EPOCH or --seed makes the output reproducible: every\n" +
+			"timestamp written is fixed and the volume serial is derived from the seed\n" +
+			"(or the epoch), so the same inputs give bit-identical images.",
+		PersistentPreRunE: func(_ *cobra.Command, _ []string) error {
+			return setupReproducible(seed)
+		},
 	}
+	root.PersistentFlags().StringVar(&seed, "seed", "", "reproducible mode: fix all timestamps and derive the volume serial from this seed")
+	root.PersistentFlags().StringVar(&auditLogFile, "audit-log", "", "audit log of device and volume writes (default $XDG_STATE_HOME/mkfat/audit.jsonl)")
 
 	// Format command
 	var (
 		ftStr, sizeStr, out, device, label, oem string
+		serialStr                               string
 		heads, spt, tracks                      int
-		force, emulate, fullFormat              bool
+		force, yes, emulate, fullFormat         bool
 		syncMode                                string
 		uiEvery                                 int
 		verifyTrack                             bool
 		attemptLLF                              bool
+		fromDir                                 string
+		badBlocksIn, badBlocksOut               string
+		badBlockSize                            int64
+		drive                                   string
+		dryRun                                  string
+		noUI                                    bool
+		progress                                string
+		output                                  string
 	)
+	formatGuard := newDeviceGuard()
 
 	formatCmd := &cobra.Command{
 		Use:   "format",
 		Short: "Format an image or block device as FAT12/16/32",
-		RunE: func(_ *cobra.Command, _ []string) error {
+		RunE: func(cmd *cobra.Command, _ []string) (err error) {
 			targets := 0
 			if out != "" {
 				targets++
@@ -1074,11 +1152,54 @@ func main() {
 			if targets > 1 {
 				return fmt.Errorf("choose at most one of --out or --device")
 			}
-			if !emulate && targets == 0 {
-				return fmt.Errorf("choose --out or --device, or use --emulate")
+			switch dryRun {
+			case "", "text", "json":
+			default:
+				return fmt.Errorf("unknown --dry-run format %q (want text or json)", dryRun)
+			}
+			if !emulate && targets == 0 && dryRun == "" {
+				return fmt.Errorf("choose --out or --device, or use --emulate or --dry-run")
+			}
+			switch progress {
+			case "", "text", "json":
+			default:
+				return fmt.Errorf("unknown --progress format %q (want text or json)", progress)
+			}
+			if uiEvery < 1 {
+				return fmt.Errorf("--ui-every must be at least 1")
+			}
+			if err := checkOutputFormat(output); err != nil {
+				return err
+			}
+			if output != "text" && dryRun != "" {
+				return fmt.Errorf("--output cannot be used with --dry-run (use --dry-run=json)")
+			}
+			if emulate && dryRun != "" {
+				return fmt.Errorf("--dry-run cannot be used with --emulate")
 			}
-			if device != "" && !force {
-				return fmt.Errorf("--device requires --force")
+			if fromDir != "" && emulate {
+				return fmt.Errorf("--from-dir cannot be used with --emulate")
+			}
+			if drive != "auto" && !emulate {
+				return fmt.Errorf("--drive needs --emulate")
+			}
+			if (badBlocksIn != "" || badBlocksOut != "") && emulate {
+				return fmt.Errorf("--badblocks and --badblocks-out cannot be used with --emulate")
+			}
+			if badBlocksOut != "" && !fullFormat {
+				return fmt.Errorf("--badblocks-out needs --full to find bad sectors")
+			}
+			// One normalized label for the boot sector and the root entry.
+			if label, err = normalizeLabel(label); err != nil {
+				return err
+			}
+			serial := newSerial()
+			if serialStr != "" {
+				n, err := parseSerial(serialStr)
+				if err != nil {
+					return err
+				}
+				serial = n
 			}
 			// Windows: disallow raw device formatting to USB floppies
 			if device != "" && runtime.GOOS == "windows" {
@@ -1094,7 +1215,6 @@ func main() {
 			if sz%512 != 0 {
 				return fmt.Errorf("size must be multiple of 512")
 			}
-
 			var ft FATType
 			switch strings.ToLower(ftStr) {
 			case "fat12":
@@ -1140,20 +1260,114 @@ func main() {
 			if err != nil {
 				return err
 			}
+			var knownBad []int64
+			if badBlocksIn != "" {
+				if knownBad, err = readBadBlocks(badBlocksIn, badBlockSize); err != nil {
+					return fmt.Errorf("--badblocks: %w", err)
+				}
+				if err := checkBadSectorsUsable(ft, g, fatSecs, rootSecs, int64(sz/512), knownBad); err != nil {
+					return fmt.Errorf("--badblocks: %w", err)
+				}
+			}
+			var paced *pacedWriter
+			if emulate {
+				p, err := driveProfileFor(drive, sz)
+				if err != nil {
+					return err
+				}
+				if p != nil {
+					if paced, err = newPacedWriter(nullWriter{}, p, g); err != nil {
+						return err
+					}
+				}
+			}
+			var st treeStats
+			if fromDir != "" {
+				st, err = planTree(fromDir, int64(g.SectorsPerCluster)*int64(g.BytesPerSector))
+				if err != nil {
+					return fmt.Errorf("--from-dir: %w", err)
+				}
+				bad := badClusterCount(g, fatSecs, rootSecs, knownBad)
+				if err := checkTreeFits(ft, g, clusters, bad, st, label); err != nil {
+					return fmt.Errorf("--from-dir: %w", err)
+				}
+			}
 
-			ui, err := retrodfrg.NewUI()
-			if err != nil {
-				return fmt.Errorf("ui init: %w", err)
+			if device != "" && dryRun == "" {
+				if err := formatGuard.check(device); err != nil {
+					return err
+				}
+				if !force && !yes {
+					if err := confirmDevice(formatGuard.identify(device), "format", os.Stdin, os.Stderr); err != nil {
+						return err
+					}
+				}
+			}
+
+			// Record the run in the audit log, with the previous contents of
+			// a device and the hash of the volume written.
+			var auditBad int
+			if !emulate && dryRun == "" {
+				target := out
+				if device != "" {
+					target = device
+				}
+				audit := newAuditEntry("format", target)
+				if device != "" {
+					audit.identify(formatGuard, device)
+				}
+				defer func() {
+					if err == nil {
+						audit.SHA256, _ = hashFile(target, sz)
+					}
+					audit.BadSectors = auditBad
+					audit.finish(err)
+				}()
+			}
+
+			plan := buildFormatPlan(ft, g, fatSecs, rootSecs, clusters, sz, label, oem, serial, fullFormat)
+			if fullFormat || len(knownBad) > 0 {
+				a := "mark the clusters holding bad sectors bad in every FAT copy"
+				if len(knownBad) > 0 {
+					a += fmt.Sprintf(" (%d sector(s) from %s)", len(knownBad), badBlocksIn)
+				}
+				plan.After = append(plan.After, a)
+			}
+			if badBlocksOut != "" {
+				plan.After = append(plan.After, "write the bad sectors found to "+badBlocksOut)
+			}
+			if fromDir != "" {
+				plan.After = append(plan.After, fmt.Sprintf("copy %d file(s) in %d director(ies), %d bytes, from %s", st.Files, st.Dirs, st.Bytes, fromDir))
+			}
+			if dryRun != "" {
+				return plan.print(os.Stdout, dryRun)
+			}
+
+			// Without a terminal, or when asked, run headless and log the
+			// progress instead of drawing it
+			headless := noUI || progress != "" || !isTerminal(os.Stdout)
+			var ui *retrodfrg.UI
+			if !headless {
+				if ui, err = retrodfrg.NewUI(); err != nil {
+					headless = true
+				}
+			}
+			if headless {
+				ui = retrodfrg.NewHeadless()
 			}
 			defer ui.Close()
 
 			startTime := time.Now()
 			totalSectors := int64(sz / 512)
 			pt := newProgressTracker(totalSectors)
+			pt.every = int64(uiEvery)
+			if headless {
+				pt.report = newProgressReporter(os.Stderr, progress == "json", startTime, totalSectors, pt.every)
+			}
 
 			// Generic UI config
 			ui.SetTitle(fmt.Sprintf("FORMAT – DRIVE %s:  FAT%d  %d bytes", "A", ft, sz))
-			ui.SetPhases([]string{"Boot", "FAT1", "FAT2", "Root"})
+			ui.SetPhases(plan.Phases)
 			// Compute absolute ranges
 			absFAT1 := int64(g.ReservedSectors)
 			absFAT2 := absFAT1 + int64(fatSecs)
@@ -1171,116 +1385,52 @@ func main() {
 			if ft != FAT32 {
 				systemRanges = append(systemRanges, [2]int64{absRoot, absRoot + int64(rootSecs) - 1})
 			}
-			ui.SetSummaryLines([]string{
+			summary := []string{
 				fmt.Sprintf("Bytes/Sector: %-4d  Sectors/Track: %-2d  Heads: %-2d", g.BytesPerSector, g.SectorsPerTrack, g.NumHeads),
 				fmt.Sprintf("Reserved: %-3d  FATs: %-1d  Root entries: %-3d", g.ReservedSectors, g.NumFATs, g.RootEntries),
 				fmt.Sprintf("Sectors/FAT: %-4d  RootDir sectors: %-3d  Data sectors: %-4d", fatSecs, rootSecs, dataSecs),
-			})
+			}
+			if paced != nil {
+				summary = append(summary, "Drive: "+paced.String())
+			}
+			ui.SetSummaryLines(summary)
 			ui.SetLegend([]string{
 				"Legend:  █ formatted/written   ░ not yet written   ■ system area | Q to quit",
 			})
 
-			// Setup Ctrl+C handler to exit immediately
+			// Ctrl+C stops the format at the next write. RunE then returns
+			// normally, so the audit entry records the interrupted run.
 			sigChan := make(chan os.Signal, 1)
 			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sigChan)
 			go func() {
-				<-sigChan
-				ui.RequestStop()
-				fmt.Fprintf(os.Stderr, "\nInterrupted\n")
-				os.Exit(130)
-			}()
-
-			if emulate {
-				emuRate := defaultEmuBPS(sz)
-				updateStatusLines(ui, pt, startTime, "Write boot sector", emuRate, true, systemRanges)
-				ui.LayoutAndDraw()
-				// Emulate using nullWriter and helpers
-				nw := nullWriter{}
-				// boot
-				var boot []byte
-				if ft == FAT32 {
-					boot = buildBootSector32(g, label, oem)
-				} else {
-					boot = buildBootSector1216(ft, g, label, oem)
-				}
-				if err := writeSpanWithStatus(nw, 0, boot, ui, pt, "Write boot sector", startTime, emuRate, true, systemRanges); err != nil && !errors.Is(err, retrodfrg.ErrInterrupted) {
-					return err
-				}
-				ui.SetPhaseDone("boot")
-				updateStatusLines(ui, pt, startTime, "Write boot sector", emuRate, true, systemRanges)
-				ui.LayoutAndDraw()
-				if ft == FAT32 {
-					updateStatusLines(ui, pt, startTime, "Write FSInfo", emuRate, true, systemRanges)
-					ui.LayoutAndDraw()
-					fsinfo := buildFSInfo()
-					if err := writeSpanWithStatus(nw, int64(g.FSInfoSector), fsinfo, ui, pt, "Write FSInfo", startTime, emuRate, true, systemRanges); err != nil && !errors.Is(err, retrodfrg.ErrInterrupted) {
-						return err
-					}
-					updateStatusLines(ui, pt, startTime, "Backup boot sector", emuRate, true, systemRanges)
-					ui.LayoutAndDraw()
-					if err := writeSpanWithStatus(nw, int64(g.BackupBootSector), boot, ui, pt, "Backup boot sector", startTime, emuRate, true, systemRanges); err != nil && !errors.Is(err, retrodfrg.ErrInterrupted) {
-						return err
-					}
-				}
-				// FATs
-				updateStatusLines(ui, pt, startTime, "Initialize FAT #1", emuRate, true, systemRanges)
-				ui.LayoutAndDraw()
-				fatBytes := int64(fatSecs) * int64(g.BytesPerSector)
-				fatBuf := make([]byte, fatBytes)
-				if ft == FAT32 {
-					initFAT32(fatBuf, g.Media)
-				} else {
-					initFAT1216(ft, fatBuf, g.Media)
-				}
-				if err := writeSpanWithStatus(nw, int64(g.ReservedSectors), fatBuf, ui, pt, "Initialize FAT #1", startTime, emuRate, true, systemRanges); err != nil && !errors.Is(err, retrodfrg.ErrInterrupted) {
-					return err
+				if _, ok := <-sigChan; ok {
+					ui.RequestStop()
 				}
-				ui.SetPhaseDone("fat1")
-				updateStatusLines(ui, pt, startTime, "Initialize FAT #1", emuRate, true, systemRanges)
-				ui.LayoutAndDraw()
-				if err := writeSpanWithStatus(nw, int64(g.ReservedSectors)+int64(fatSecs), fatBuf, ui, pt, "Initialize FAT #2", startTime, emuRate, true, systemRanges); err != nil && !errors.Is(err, retrodfrg.ErrInterrupted) {
-					return err
-				}
-				ui.SetPhaseDone("fat2")
-				updateStatusLines(ui, pt, startTime, "Initialize FAT #2", emuRate, true, systemRanges)
-				ui.LayoutAndDraw()
-				// Root (if 12/16)
-				if ft != FAT32 {
-					updateStatusLines(ui, pt, startTime, "Clear root directory", emuRate, true, systemRanges)
-					ui.LayoutAndDraw()
-					absRoot := int64(g.ReservedSectors) + int64(g.NumFATs)*int64(fatSecs)
-					if err := zeroSpanWithStatus(nw, absRoot, int64(rootSecs), ui, pt, "Clear root directory", startTime, emuRate, true, systemRanges); err != nil && !errors.Is(err, retrodfrg.ErrInterrupted) {
-						return err
-					}
-					ui.SetPhaseDone("root")
-					updateStatusLines(ui, pt, startTime, "Clear root directory", emuRate, true, systemRanges)
-					ui.LayoutAndDraw()
-				}
-				// Data area
-				updateStatusLines(ui, pt, startTime, "Format data area", emuRate, true, systemRanges)
-				ui.LayoutAndDraw()
-				absData := int64(g.ReservedSectors) + int64(g.NumFATs)*int64(fatSecs)
-				if ft != FAT32 {
-					absData += int64(rootSecs)
-				}
-				remaining := int64(sz/512) - absData
-				if remaining > 0 {
-					_ = zeroSpanWithStatus(nw, absData, remaining, ui, pt, "Format data area", startTime, emuRate, true, systemRanges)
-				}
-				updateStatusLines(ui, pt, startTime, "Format complete", emuRate, true, systemRanges)
-				ui.LayoutAndDraw()
-				_ = waitWithStop(ui)
-				ui.Close()
+			}()
 
-				printGeometryInfo(ft, sz, g, fatSecs, rootSecs, dataSecs, clusters, label, oem)
-				fmt.Printf("\nFAT%d ready. bytes=%d emulate=true\n", ft, sz)
-				return nil
+			run := &formatRun{
+				ui:           ui,
+				pt:           pt,
+				start:        startTime,
+				emulate:      emulate,
+				systemRanges: systemRanges,
+				syncMode:     syncMode,
+				verify:       verifyTrack,
+				spt:          int(g.SectorsPerTrack),
 			}
 
-			// real write
-			var sink io.WriterAt
+			// Pick the sink: the emulator, an image file or a device
+			var sink formatSink
 			var file *os.File
-			if out != "" {
+			if emulate {
+				var nw io.WriterAt = nullWriter{}
+				if paced != nil {
+					nw = paced
+					run.emuRate = paced.rate(totalSectors)
+				}
+				sink = emulatorSink{nw}
+			} else if out != "" {
 				if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil && !errors.Is(err, os.ErrExist) {
 					return err
 				}
@@ -1361,141 +1511,135 @@ func main() {
 
 			ui.LayoutAndDraw()
 
-			// Boot
-			updateStatusLines(ui, pt, startTime, "Write boot sector", 0, false, systemRanges)
-			ui.LayoutAndDraw()
-			var boot []byte
-			if ft == FAT32 {
-				boot = buildBootSector32(g, label, oem)
-			} else {
-				boot = buildBootSector1216(ft, g, label, oem)
+			badSectors, err := plan.run(sink, run)
+			if errors.Is(err, retrodfrg.ErrInterrupted) {
+				ui.Close()
+				cmd.SilenceUsage, cmd.SilenceErrors = true, true
+				return &exitCodeError{code: 130, err: err}
 			}
-			if err := writeSpanWithStatus(sink, 0, boot, ui, pt, "Write boot sector", startTime, 0, false, systemRanges); err != nil {
+			if err != nil {
 				return err
 			}
-			if file != nil {
-				_ = file.Sync()
-			}
-			ui.SetPhaseDone("boot")
-			updateStatusLines(ui, pt, startTime, "Write boot sector", 0, false, systemRanges)
-			ui.LayoutAndDraw()
 
-			// FSInfo + backup for FAT32
-			if ft == FAT32 {
-				updateStatusLines(ui, pt, startTime, "Write FSInfo", 0, false, systemRanges)
+			if emulate {
+				updateStatusLines(ui, pt, startTime, "Format complete", run.emuRate, true, systemRanges)
 				ui.LayoutAndDraw()
-				fsinfo := buildFSInfo()
-				if err := writeSpanWithStatus(sink, int64(g.FSInfoSector), fsinfo, ui, pt, "Write FSInfo", startTime, 0, false, systemRanges); err != nil {
-					return err
-				}
-				if file != nil {
-					_ = file.Sync()
+				pt.report.done()
+				if !headless {
+					_ = waitWithStop(ui)
 				}
-				updateStatusLines(ui, pt, startTime, "Backup boot sector", 0, false, systemRanges)
-				ui.LayoutAndDraw()
-				if err := writeSpanWithStatus(sink, int64(g.BackupBootSector), boot, ui, pt, "Backup boot sector", startTime, 0, false, systemRanges); err != nil {
-					return err
+				ui.Close()
+
+				if output != "text" {
+					rep := newVolumeReport("format", "", ft, sz, g, fatSecs, rootSecs, dataSecs, clusters, label, oem, serial)
+					clusterBytes := int64(g.SectorsPerCluster) * int64(g.BytesPerSector)
+					free := clusters
+					if ft == FAT32 {
+						free-- // root directory cluster
+					}
+					rep.Result = &formatResult{Emulated: true, FreeClusters: free, FreeBytes: int64(free) * clusterBytes}
+					rep.Timing = newTimingReport(startTime)
+					if paced != nil {
+						rep.Timing.Drive = paced.String()
+						rep.Timing.DriveTime = paced.clock.Seconds()
+						rep.Timing.Seeks, rep.Timing.HeadSwitches = paced.seeks, paced.headSwitches
+					}
+					return writeStructured(os.Stdout, rep, output)
 				}
-				if file != nil {
-					_ = file.Sync()
+				printGeometryInfo(ft, sz, g, fatSecs, rootSecs, dataSecs, clusters, label, oem, serial)
+				if paced != nil {
+					fmt.Printf("\nEmulated drive: %s\n", paced)
+					fmt.Printf("Drive time: %s (%d seeks, %d head switches)\n", paced.clock.Truncate(time.Millisecond), paced.seeks, paced.headSwitches)
 				}
+				fmt.Printf("\nFAT%d ready. bytes=%d emulate=true\n", ft, sz)
+				return nil
 			}
 
-			// FAT #1
-			updateStatusLines(ui, pt, startTime, "Initialize FAT #1", 0, false, systemRanges)
-			ui.LayoutAndDraw()
-			fatBytes := int64(fatSecs) * int64(g.BytesPerSector)
-			fatBuf := make([]byte, fatBytes)
-			if ft == FAT32 {
-				initFAT32(fatBuf, g.Media)
-			} else {
-				initFAT1216(ft, fatBuf, g.Media)
-			}
-			if err := writeSpanWithStatus(sink, absFAT1, fatBuf, ui, pt, "Initialize FAT #1", startTime, 0, false, systemRanges); err != nil {
-				return err
-			}
-			if file != nil {
-				_ = file.Sync()
+			if badBlocksOut != "" {
+				if err := writeBadSectors(badBlocksOut, badSectors); err != nil {
+					return fmt.Errorf("--badblocks-out: %w", err)
+				}
 			}
-			ui.SetPhaseDone("fat1")
-			updateStatusLines(ui, pt, startTime, "Initialize FAT #1", 0, false, systemRanges)
-			ui.LayoutAndDraw()
 
-			// FAT #2
-			updateStatusLines(ui, pt, startTime, "Duplicate FAT #2", 0, false, systemRanges)
-			ui.LayoutAndDraw()
-			if err := writeSpanWithStatus(sink, absFAT2, fatBuf, ui, pt, "Duplicate FAT #2", startTime, 0, false, systemRanges); err != nil {
-				return err
-			}
-			if file != nil {
+			// Mark the clusters holding bad sectors, found or imported, in
+			// every FAT copy
+			badSectors = sortedSectors(append(badSectors, knownBad...))
+			auditBad = len(badSectors)
+			var badClusters []uint32
+			if len(badSectors) > 0 {
+				pt.report.phaseStart("Bad", "Mark bad clusters")
+				updateStatusLines(ui, pt, startTime, "Mark bad clusters", 0, false, systemRanges)
+				ui.LayoutAndDraw()
+				v, err := openFATVolume(file, file)
+				if err != nil {
+					return err
+				}
+				badClusters = v.markBad(badSectors)
+				if err := v.flush(); err != nil {
+					return err
+				}
 				_ = file.Sync()
+				pt.report.phaseEnd("Bad", "Mark bad clusters")
 			}
-			ui.SetPhaseDone("fat2")
-			updateStatusLines(ui, pt, startTime, "Duplicate FAT #2", 0, false, systemRanges)
-			ui.LayoutAndDraw()
 
-			// Root (1216)
-			if ft != FAT32 {
-				updateStatusLines(ui, pt, startTime, "Clear root directory", 0, false, systemRanges)
+			// Populate from a host directory
+			freeClusters := clusters - uint32(len(badClusters))
+			if ft == FAT32 {
+				freeClusters-- // root directory cluster
+			}
+			var copied treeStats
+			if fromDir != "" {
+				pt.report.phaseStart("Files", "Copy files from "+fromDir)
+				updateStatusLines(ui, pt, startTime, "Copy files from "+fromDir, 0, false, systemRanges)
 				ui.LayoutAndDraw()
-				if err := zeroSpanWithStatus(sink, absRoot, int64(rootSecs), ui, pt, "Clear root directory", startTime, 0, false, systemRanges); err != nil {
+				v, err := openFATVolume(file, file)
+				if err != nil {
 					return err
 				}
-				if file != nil {
-					_ = file.Sync()
-				}
-				if label != "" {
-					entry := buildRootLabelEntry(label)
-					if _, err := file.WriteAt(entry, (absRoot * 512)); err != nil {
-						return err
-					}
-					ui.LayoutAndDraw()
-				}
-				ui.SetPhaseDone("root")
-				updateStatusLines(ui, pt, startTime, "Clear root directory", 0, false, systemRanges)
-				ui.LayoutAndDraw()
-			} else {
-				_ = zeroSpanWithStatus(sink, absData, 1, ui, pt, "Clear root directory", startTime, 0, false, systemRanges)
-				if file != nil {
-					_ = file.Sync()
+				copied, err = putTree(v, 0, fromDir)
+				if err != nil {
+					return err
 				}
-			}
-
-			// Full format data area with sync policy
-			if fullFormat {
-				remainingSectors := int64(sz/512) - absData
-				if remainingSectors > 0 {
-					switch strings.ToLower(syncMode) {
-					case "sector":
-						updateStatusLines(ui, pt, startTime, "Full format (sector): zeroing data area", 0, false, systemRanges)
-						ui.LayoutAndDraw()
-						if err := fullFormatDataArea(file, absData, remainingSectors, ui, pt, "Full format (sector): zeroing data area", startTime, systemRanges); err != nil {
-							fmt.Fprintf(os.Stderr, "\nWARNING: %v\n", err)
-						}
-					case "track", "phase", "none":
-						updateStatusLines(ui, pt, startTime, "Full format (track): zeroing data area", 0, false, systemRanges)
-						ui.LayoutAndDraw()
-						if err := fullFormatTrack(file, absData, remainingSectors, int(g.SectorsPerTrack), ui, pt, syncMode, "Full format (track): zeroing data area", startTime, systemRanges); err != nil {
-							fmt.Fprintf(os.Stderr, "\nWARNING: %v\n", err)
-						}
-						if verifyTrack {
-							updateStatusLines(ui, pt, startTime, "Verify data area (track)", 0, false, systemRanges)
-							ui.LayoutAndDraw()
-							_ = verifyTrackRead(file, absData, remainingSectors, int(g.SectorsPerTrack))
-						}
-					}
+				if err := v.flush(); err != nil {
+					return err
 				}
+				_ = file.Sync()
+				freeClusters = v.freeClusters()
+				pt.report.phaseEnd("Files", "Copy files from "+fromDir)
 			}
 
 			updateStatusLines(ui, pt, startTime, "Format complete", 0, false, systemRanges)
 			ui.LayoutAndDraw()
+			pt.report.done()
 
-			if err := waitWithStop(ui); err != nil && !errors.Is(err, retrodfrg.ErrInterrupted) {
-				return err
+			if !headless {
+				if err := waitWithStop(ui); err != nil && !errors.Is(err, retrodfrg.ErrInterrupted) {
+					return err
+				}
 			}
 			ui.Close()
 
-			printGeometryInfo(ft, sz, g, fatSecs, rootSecs, dataSecs, clusters, label, oem)
+			clusterBytes := int64(g.SectorsPerCluster) * int64(g.BytesPerSector)
+			if output != "text" {
+				target := out
+				if device != "" {
+					target = device
+				}
+				rep := newVolumeReport("format", target, ft, sz, g, fatSecs, rootSecs, dataSecs, clusters, label, oem, serial)
+				rep.Result = &formatResult{
+					BadSectors:   len(badSectors),
+					BadClusters:  len(badClusters),
+					FreeClusters: freeClusters,
+					FreeBytes:    int64(freeClusters) * clusterBytes,
+					CopiedFiles:  copied.Files,
+					CopiedDirs:   copied.Dirs,
+					CopiedBytes:  copied.Bytes,
+				}
+				rep.Timing = newTimingReport(startTime)
+				return writeStructured(os.Stdout, rep, output)
+			}
+
+			printGeometryInfo(ft, sz, g, fatSecs, rootSecs, dataSecs, clusters, label, oem, serial)
 
 			total := uint32(0)
 			if g.TotalSectors16 != 0 {
@@ -1503,8 +1647,13 @@ func main() {
 			} else {
 				total = g.TotalSectors32
 			}
-			fmt.Printf("\nFAT%d ready. bytes=%d sectors=%d clusterSize=%dB clusters=%d fatSectors=%d rootDirSectors=%d dataSectors=%d emulate=false\n",
-				ft, sz, total, int(g.SectorsPerCluster)*int(g.BytesPerSector), clusters, fatSecs, rootSecs, dataSecs)
+			if fromDir != "" {
+				fmt.Printf("\nCopied %d file(s) in %d director(ies), %d bytes from %s\n", copied.Files, copied.Dirs, copied.Bytes, fromDir)
+			}
+			fmt.Println()
+			printDiskSummary(clusters, uint32(len(badClusters)), freeClusters, clusterBytes, serial)
+			fmt.Printf("\nFAT%d ready. bytes=%d sectors=%d clusterSize=%dB clusters=%d fatSectors=%d rootDirSectors=%d dataSectors=%d free=%d emulate=false\n",
+				ft, sz, total, clusterBytes, clusters, fatSecs, rootSecs, dataSecs, int64(freeClusters)*clusterBytes)
 			return nil
 		},
 	}
@@ -1515,18 +1664,31 @@ func main() {
 	_ = formatCmd.MarkFlagRequired("size")
 	formatCmd.Flags().StringVar(&out, "out", "", "output image file path")
 	formatCmd.Flags().StringVar(&device, "device", "", "block device path (e.g. /dev/fd0, /dev/sdb) [DANGEROUS]")
-	formatCmd.Flags().BoolVar(&force, "force", false, "required with --device")
+	formatCmd.Flags().BoolVar(&force, "force", false, "do not ask before formatting --device")
+	formatCmd.Flags().BoolVar(&yes, "yes", false, "same as --force, for scripts")
 	formatCmd.Flags().StringVar(&label, "label", "", "volume label (<=11 ASCII)")
 	formatCmd.Flags().StringVar(&oem, "oem", "EARMKFAT", "OEM string (<=8 ASCII)")
+	formatCmd.Flags().StringVar(&serialStr, "serial", "", "volume serial number, e.g. 1234-ABCD (default: derived from the format time)")
 	formatCmd.Flags().IntVar(&heads, "heads", 0, "override number of heads")
 	formatCmd.Flags().IntVar(&spt, "spt", 0, "override sectors per track")
 	formatCmd.Flags().IntVar(&tracks, "tracks", 0, "override cylinders")
 	formatCmd.Flags().BoolVar(&emulate, "emulate", false, "simulate floppy timing (no writes)")
+	formatCmd.Flags().StringVar(&drive, "drive", "auto", "drive to emulate with --emulate: auto|none|360k|720k|1.2m|1.44m|2.88m")
+	formatCmd.Flags().StringVar(&dryRun, "dry-run", "", "print the write plan instead of formatting: text|json")
+	formatCmd.Flags().Lookup("dry-run").NoOptDefVal = "text"
 	formatCmd.Flags().BoolVar(&fullFormat, "full", false, "full format: zero all data sectors and check for bad sectors")
 	formatCmd.Flags().StringVar(&syncMode, "sync", "track", "sync policy: sector|track|phase|none")
-	formatCmd.Flags().IntVar(&uiEvery, "ui-every", 64, "redraw UI every N sectors (REAL mode)")
+	formatCmd.Flags().IntVar(&uiEvery, "ui-every", 64, "update the UI, or emit a progress event, every N sectors")
+	formatCmd.Flags().BoolVar(&noUI, "no-ui", false, "run without the full-screen UI and log progress to stderr (the default without a terminal)")
+	formatCmd.Flags().StringVar(&progress, "progress", "", "headless progress on stderr: text|json (newline-delimited events; implies --no-ui)")
+	formatCmd.Flags().StringVar(&output, "output", "text", "result format on stdout: text|json|yaml")
 	formatCmd.Flags().BoolVar(&verifyTrack, "verify", false, "verify one sector per track after formatting")
 	formatCmd.Flags().BoolVar(&attemptLLF, "llf", false, "attempt low-level track format if device is not yet formatted")
+	formatCmd.Flags().StringVar(&fromDir, "from-dir", "", "copy the contents of this host directory into the new filesystem")
+	formatCmd.Flags().StringVar(&badBlocksIn, "badblocks", "", "read a list of bad blocks from this file and mark their clusters bad")
+	formatCmd.Flags().Int64Var(&badBlockSize, "badblocks-size", 512, "bytes per block in the --badblocks list (1024 for badblocks(8) defaults)")
+	formatCmd.Flags().StringVar(&badBlocksOut, "badblocks-out", "", "write the bad sectors found by --full to this file")
+	formatGuard.addFlags(formatCmd)
 
 	root.AddCommand(formatCmd)
 
@@ -1573,29 +1735,45 @@ func main() {
 		img2devIn     string
 		img2devDevice string
 		img2devForce  bool
+		img2devYes    bool
 		img2devBlock  int
 	)
+	img2devGuard := newDeviceGuard()
 	copyToDevice := &cobra.Command{
 		Use:   "img2dev --in <image> --device <device>",
 		Short: "Copy from image file to device (restore)",
-		RunE: func(_ *cobra.Command, _ []string) error {
+		RunE: func(_ *cobra.Command, _ []string) (err error) {
 			if img2devIn == "" {
 				return fmt.Errorf("--in is required")
 			}
 			if img2devDevice == "" {
 				return fmt.Errorf("--device is required")
 			}
-			if !img2devForce {
-				return fmt.Errorf("--force is required for device operations")
+			if err := img2devGuard.check(img2devDevice); err != nil {
+				return err
+			}
+			if !img2devForce && !img2devYes {
+				if err := confirmDevice(img2devGuard.identify(img2devDevice), "overwrite", os.Stdin, os.Stderr); err != nil {
+					return err
+				}
+			}
+			audit := newAuditEntry("img2dev", img2devDevice)
+			audit.identify(img2devGuard, img2devDevice)
+			audit.Image = img2devIn
+			if fi, err := os.Stat(img2devIn); err == nil {
+				audit.SHA256, _ = hashFile(img2devIn, fi.Size())
 			}
+			defer func() { audit.finish(err) }()
 
 			return copyImageToDevice(img2devIn, img2devDevice, int64(img2devBlock))
 		},
 	}
 	copyToDevice.Flags().StringVar(&img2devIn, "in", "", "source image file")
 	copyToDevice.Flags().StringVar(&img2devDevice, "device", "", "target block device (e.g. /dev/disk2)")
-	copyToDevice.Flags().BoolVar(&img2devForce, "force", false, "confirm device operation")
+	copyToDevice.Flags().BoolVar(&img2devForce, "force", false, "do not ask before overwriting the device")
+	copyToDevice.Flags().BoolVar(&img2devYes, "yes", false, "same as --force, for scripts")
 	copyToDevice.Flags().IntVar(&img2devBlock, "block-size", 512, "block size for copying (bytes)")
+	img2devGuard.addFlags(copyToDevice)
 	_ = copyToDevice.MarkFlagRequired("in")
 	_ = copyToDevice.MarkFlagRequired("device")
 
@@ -1609,28 +1787,54 @@ func main() {
 		Short: "Device related utilities (safe, read-only)",
 	}
 
-	var listAll bool
+	var (
+		listAll, listJSON, listRemovable bool
+		listMaxSize                      int64
+	)
 	listCmd := &cobra.Command{
 		Use:   "list",
 		Short: "List compatible and non-compatible devices for formatting (read-only)",
 		RunE: func(_ *cobra.Command, _ []string) error {
-			infos, err := discoverDevices()
+			all, err := discoverDevices()
 			if err != nil {
 				return err
 			}
+			infos := filterDevices(all, listRemovable, listMaxSize)
+			if listJSON {
+				out := []deviceInfo{}
+				for _, d := range infos {
+					if !d.Compatible && !listAll {
+						continue
+					}
+					if d.Compatible {
+						if sig, err := detectFilesystemPath(d.Path); err == nil {
+							d.Contents = &sig
+						}
+					}
+					out = append(out, d)
+				}
+				return writeStructured(os.Stdout, out, "json")
+			}
 			fmt.Printf("OS: %s\n", runtime.GOOS)
 			fmt.Println("This is a SAFE, read-only listing. No formatting will be performed.")
 			fmt.Println()
 			fmt.Println("Compatible devices (usable with --device):")
 			// Table header
-			fmt.Printf("  %-18s  %-12s  %-20s  %-8s\n", "Path", "Type", "Serial", "Size")
+			fmt.Printf("  %-18s  %-12s  %-20s  %-8s  %s\n", "Path", "Type", "Serial", "Size", "Contents")
 			printedCompat := false
 			for _, d := range infos {
 				if !d.Compatible {
 					continue
 				}
 				dtype, serial, sizeStr := getDeviceDetails(d.Path)
-				fmt.Printf("  %-18s  %-12s  %-20s  %-8s\n", d.Path, dtype, serial, sizeStr)
+				if bd := d.Block; bd != nil {
+					dtype, serial, sizeStr = blockDeviceDetails(bd)
+				}
+				contents := "-"
+				if sig, err := detectFilesystemPath(d.Path); err == nil {
+					contents = sig.String()
+				}
+				fmt.Printf("  %-18s  %-12s  %-20s  %-8s  %s\n", d.Path, dtype, serial, sizeStr, contents)
 				printedCompat = true
 			}
 			if !printedCompat {
@@ -1677,7 +1881,7 @@ func main() {
 			case "darwin":
 				fmt.Println("  - Whole disks are typically /dev/diskN. Partitions like /dev/diskNsM are not compatible.")
 			case "linux":
-				fmt.Println("  - Whole disks: /dev/sdX, /dev/vdX, /dev/nvmeXnY, /dev/mmcblkX. Partitions (digits) are not compatible.")
+				fmt.Println("  - Devices come from /sys/class/block. Partitions, read-only and in-use devices are not compatible.")
 			case "windows":
 				fmt.Println("  - Raw device formatting of USB floppies is not supported on Windows. Use --out to create an image.")
 			}
@@ -1685,6 +1889,9 @@ func main() {
 		},
 	}
 	listCmd.Flags().BoolVar(&listAll, "all", false, "include non-compatible devices/partitions in output")
+	listCmd.Flags().BoolVar(&listJSON, "json", false, "print the devices as JSON, with everything sysfs reports")
+	listCmd.Flags().BoolVar(&listRemovable, "removable", false, "only removable devices (Linux)")
+	listCmd.Flags().Var(&sizeFlag{&listMaxSize}, "max-size", "only devices no larger than this, e.g. 64g (Linux)")
 
 	deviceCmd.AddCommand(listCmd)
 
@@ -1752,6 +1959,9 @@ func main() {
 					fmt.Printf("  Media:   %s\n", typ)
 				}
 			}
+			if sig, err := detectFilesystemPath(dev); err == nil {
+				fmt.Printf("  Content: %s\n", sig)
+			}
 			return nil
 		},
 	}
@@ -1760,14 +1970,28 @@ func main() {
 	deviceCmd.AddCommand(infoCmd)
 	root.AddCommand(deviceCmd)
 
+	root.AddCommand(newLsCmd())
+	root.AddCommand(newPutCmd())
+	root.AddCommand(newGetCmd())
+	root.AddCommand(newExtractCmd())
+	root.AddCommand(newCheckCmd())
+	root.AddCommand(newDefragCmd())
+	root.AddCommand(newUndeleteCmd())
+	root.AddCommand(newLabelCmd())
+	root.AddCommand(newScanCmd())
+	root.AddCommand(newInspectCmd())
+	root.AddCommand(newLogCmd())
+
 	must(root.Execute())
 }
 
 // Device discovery (read-only)
 type deviceInfo struct {
-	Path       string
-	Compatible bool
-	Reason     string
+	Path       string       `json:"path"`
+	Compatible bool         `json:"compatible"`
+	Reason     string       `json:"reason,omitempty"`
+	Block      *blockDevice `json:"block,omitempty"`    // Linux only
+	Contents   *fsSignature `json:"contents,omitempty"` // filled in by device list
 }
 
 func discoverDevices() ([]deviceInfo, error) {
@@ -1812,7 +2036,12 @@ func discoverDarwin() ([]deviceInfo, error) {
 	return infos, nil
 }
 
+// discoverLinux lists the block devices sysfs knows, falling back to
+// guessing from the names in /dev when sysfs is not mounted.
 func discoverLinux() ([]deviceInfo, error) {
+	if infos, err := blockDeviceInfos("/sys"); err == nil {
+		return infos, nil
+	}
 	entries, err := os.ReadDir("/dev")
 	if err != nil {
 		return nil, err
@@ -2067,11 +2296,13 @@ func getDeviceDetails(path string) (string, string, string) {
 	return dtype, serial, sizeStr
 }
 
-// Track-based zeroing with sync policy
-func fullFormatTrack(file *os.File, absStart, sectors int64, spt int, ui *retrodfrg.UI, pt *progressTracker, syncMode string, currentOp string, startTime time.Time, systemRanges [][2]int64) error {
+// Track-based zeroing with sync policy. A track that cannot be written is
+// checked sector by sector; the sectors that fail are returned.
+func fullFormatTrack(file formatRW, absStart, sectors int64, spt int, ui *retrodfrg.UI, pt *progressTracker, syncMode string, currentOp string, startTime time.Time, systemRanges [][2]int64) ([]int64, error) {
 	if spt <= 0 {
 		spt = 18
 	}
+	badSectors := []int64{}
 	written := int64(0)
 	for written < sectors {
 		chunk := int64(spt)
@@ -2079,7 +2310,16 @@ func fullFormatTrack(file *os.File, absStart, sectors int64, spt int, ui *retrod
 			chunk = sectors - written
 		}
 		if err := zeroSpanWithStatus(file, absStart+written, chunk, ui, pt, currentOp, startTime, 0, false, systemRanges); err != nil {
-			return err
+			if errors.Is(err, retrodfrg.ErrInterrupted) {
+				return badSectors, err
+			}
+			for sec := absStart + written; sec < absStart+written+chunk; sec++ {
+				if checkBadSector(file, sec) != nil {
+					badSectors = append(badSectors, sec)
+					pt.report.badSector(sec)
+				}
+			}
+			pt.markRange(absStart+written, chunk)
 		}
 		// Sync once per track unless disabled
 		switch strings.ToLower(syncMode) {
@@ -2094,7 +2334,7 @@ func fullFormatTrack(file *os.File, absStart, sectors int64, spt int, ui *retrod
 	if strings.ToLower(syncMode) == "phase" {
 		_ = file.Sync()
 	}
-	return nil
+	return badSectors, nil
 }
 
 // Verify one sector per track (best-effort)
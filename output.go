@@ -0,0 +1,324 @@
+// output.go
+// Machine-readable output: the versioned volume report printed by
+// format --output json|yaml and the inspection commands, and a small YAML
+// emitter so the same structs can be printed as YAML without a dependency.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// volumeReportSchema names the schema of volumeReport. Its version is
+// bumped whenever a field is renamed, removed or changes meaning; adding
+// fields does not bump it, so readers must ignore fields they do not know.
+const (
+	volumeReportSchema  = "mkfat.volume"
+	volumeReportVersion = 1
+)
+
+// volumeReport describes a FAT volume, schema mkfat.volume version 1:
+//
+//	schema, version  "mkfat.volume" and 1
+//	command          the command that produced it: "format" or "inspect"
+//	target           the image or device, "" when emulated
+//	type             "FAT12", "FAT16" or "FAT32"
+//	bytes            size of the volume in bytes
+//	label            volume label from the boot sector, "" for none
+//	oem              OEM name from the boot sector
+//	serial           volume serial number as "XXXX-XXXX"
+//	geometry         every BPB field (see geom), plus cylinders
+//	layout           the computed layout, with inclusive absolute sector
+//	                 ranges: reserved, fats[], root (FAT12/16 only), data
+//	partition        inspect only: the MBR entry the volume was read from
+//	boot             inspect only: boot signature and extended BPB fields
+//	issues           inspect only: inconsistencies found in the BPB
+//	result           format only: clusters free and bad, files copied
+//	timing           format only: start time, elapsed seconds and, when
+//	                 emulated, the drive model and its simulated time
+type volumeReport struct {
+	Schema    string         `json:"schema"`
+	Version   int            `json:"version"`
+	Command   string         `json:"command"`
+	Target    string         `json:"target"`
+	Type      string         `json:"type"`
+	Bytes     int64          `json:"bytes"`
+	Label     string         `json:"label"`
+	OEM       string         `json:"oem"`
+	Serial    string         `json:"serial"`
+	Geometry  geometryReport `json:"geometry"`
+	Layout    layoutReport   `json:"layout"`
+	Partition *mbrPartition  `json:"partition,omitempty"`
+	Boot      *bootRecord    `json:"boot,omitempty"`
+	Issues    []checkIssue   `json:"issues,omitempty"`
+	Result    *formatResult  `json:"result,omitempty"`
+	Timing    *timingReport  `json:"timing,omitempty"`
+}
+
+// geometryReport is the BPB plus the cylinder count it implies.
+type geometryReport struct {
+	geom
+	Cylinders int64 `json:"cylinders"`
+}
+
+// sectorRange is an inclusive range of absolute sectors.
+type sectorRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+type layoutReport struct {
+	TotalSectors   int64         `json:"total_sectors"`
+	FATSectors     uint32        `json:"fat_sectors"`
+	RootDirSectors uint32        `json:"root_dir_sectors"`
+	DataSectors    uint32        `json:"data_sectors"`
+	Clusters       uint32        `json:"clusters"`
+	ClusterBytes   int64         `json:"cluster_bytes"`
+	Reserved       sectorRange   `json:"reserved"`
+	FATs           []sectorRange `json:"fats"`
+	Root           *sectorRange  `json:"root,omitempty"`
+	Data           sectorRange   `json:"data"`
+}
+
+type formatResult struct {
+	Emulated     bool   `json:"emulated"`
+	BadSectors   int    `json:"bad_sectors"`
+	BadClusters  int    `json:"bad_clusters"`
+	FreeClusters uint32 `json:"free_clusters"`
+	FreeBytes    int64  `json:"free_bytes"`
+	CopiedFiles  int    `json:"copied_files,omitempty"`
+	CopiedDirs   int    `json:"copied_dirs,omitempty"`
+	CopiedBytes  int64  `json:"copied_bytes,omitempty"`
+}
+
+type timingReport struct {
+	Started      string  `json:"started"`
+	Elapsed      float64 `json:"elapsed"` // seconds
+	Drive        string  `json:"drive,omitempty"`
+	DriveTime    float64 `json:"drive_time,omitempty"` // simulated seconds
+	Seeks        int     `json:"seeks,omitempty"`
+	HeadSwitches int     `json:"head_switches,omitempty"`
+}
+
+// newVolumeReport fills in everything but the result and timing.
+func newVolumeReport(command, target string, ft FATType, size int64, g geom, fatSecs, rootSecs, dataSecs, clusters uint32, label, oem string, serial uint32) *volumeReport {
+	total := size / int64(g.BytesPerSector)
+	var cyl int64
+	if g.SectorsPerTrack > 0 && g.NumHeads > 0 {
+		cyl = total / int64(g.SectorsPerTrack) / int64(g.NumHeads)
+	}
+	l := layoutReport{
+		TotalSectors:   total,
+		FATSectors:     fatSecs,
+		RootDirSectors: rootSecs,
+		DataSectors:    dataSecs,
+		Clusters:       clusters,
+		ClusterBytes:   int64(g.SectorsPerCluster) * int64(g.BytesPerSector),
+		Reserved:       sectorRange{0, int64(g.ReservedSectors) - 1},
+	}
+	next := int64(g.ReservedSectors)
+	for i := 0; i < int(g.NumFATs); i++ {
+		l.FATs = append(l.FATs, sectorRange{next, next + int64(fatSecs) - 1})
+		next += int64(fatSecs)
+	}
+	if ft != FAT32 {
+		l.Root = &sectorRange{next, next + int64(rootSecs) - 1}
+		next += int64(rootSecs)
+	}
+	l.Data = sectorRange{next, total - 1}
+	return &volumeReport{
+		Schema:   volumeReportSchema,
+		Version:  volumeReportVersion,
+		Command:  command,
+		Target:   target,
+		Type:     fmt.Sprintf("FAT%d", ft),
+		Bytes:    size,
+		Label:    strings.ToUpper(strings.TrimSpace(label)),
+		OEM:      strings.TrimSpace(oem),
+		Serial:   fmt.Sprintf("%04X-%04X", serial>>16, serial&0xFFFF),
+		Geometry: geometryReport{geom: g, Cylinders: cyl},
+		Layout:   l,
+	}
+}
+
+func newTimingReport(start time.Time) *timingReport {
+	return &timingReport{Started: stampTime(start).Format(time.RFC3339), Elapsed: time.Since(start).Seconds()}
+}
+
+// checkOutputFormat validates an --output value; text is always allowed.
+func checkOutputFormat(format string) error {
+	switch format {
+	case "text", "json", "yaml":
+		return nil
+	}
+	return fmt.Errorf("unknown --output %q (want text, json or yaml)", format)
+}
+
+// writeStructured prints v as indented JSON or as YAML.
+func writeStructured(w io.Writer, v any, format string) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if format == "yaml" {
+		if b, err = jsonToYAML(b); err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+/* ===================== YAML ===================== */
+
+// jsonToYAML converts a JSON document to block-style YAML, keeping the key
+// order. It covers what encoding/json produces, which is all the reports
+// need.
+func jsonToYAML(doc []byte) ([]byte, error) {
+	// Walk the tokens rather than decoding into maps, which lose the order.
+	d := json.NewDecoder(bytes.NewReader(doc))
+	d.UseNumber()
+	node, err := readYAMLNode(d)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	writeYAMLNode(&b, node, 0, false)
+	return b.Bytes(), nil
+}
+
+// yamlNode is an ordered JSON value: a scalar, a list or a mapping.
+type yamlNode struct {
+	scalar string // already rendered
+	list   []*yamlNode
+	keys   []string
+	vals   []*yamlNode
+	kind   byte // 's', 'l' or 'm'
+}
+
+func readYAMLNode(d *json.Decoder) (*yamlNode, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := t.(type) {
+	case json.Delim:
+		switch t {
+		case '[':
+			n := &yamlNode{kind: 'l'}
+			for d.More() {
+				c, err := readYAMLNode(d)
+				if err != nil {
+					return nil, err
+				}
+				n.list = append(n.list, c)
+			}
+			_, err := d.Token()
+			return n, err
+		case '{':
+			n := &yamlNode{kind: 'm'}
+			for d.More() {
+				k, err := d.Token()
+				if err != nil {
+					return nil, err
+				}
+				c, err := readYAMLNode(d)
+				if err != nil {
+					return nil, err
+				}
+				n.keys = append(n.keys, k.(string))
+				n.vals = append(n.vals, c)
+			}
+			_, err := d.Token()
+			return n, err
+		}
+		return nil, fmt.Errorf("unexpected %v", t)
+	case string:
+		return &yamlNode{kind: 's', scalar: yamlString(t)}, nil
+	case json.Number:
+		return &yamlNode{kind: 's', scalar: t.String()}, nil
+	case bool:
+		return &yamlNode{kind: 's', scalar: fmt.Sprint(t)}, nil
+	case nil:
+		return &yamlNode{kind: 's', scalar: "null"}, nil
+	}
+	return nil, fmt.Errorf("unexpected token %v", t)
+}
+
+// yamlPlain matches strings that YAML reads back as the same string
+// without quotes.
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_/][A-Za-z0-9_./ ()-]*$`)
+
+// yamlString renders s plain when that is unambiguous, else double quoted
+// (JSON escapes are valid in YAML double-quoted scalars).
+func yamlString(s string) string {
+	switch strings.ToLower(s) {
+	case "true", "false", "yes", "no", "on", "off", "null", "y", "n", "~":
+		return fmt.Sprintf("%q", s)
+	}
+	if yamlPlain.MatchString(s) && !strings.HasSuffix(s, " ") {
+		return s
+	}
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// writeYAMLNode writes n at the given indent. inList means n follows a
+// "- " marker, so its first mapping key goes on that line.
+func writeYAMLNode(b *bytes.Buffer, n *yamlNode, indent int, inList bool) {
+	pad := strings.Repeat("  ", indent)
+	switch n.kind {
+	case 'm':
+		if len(n.keys) == 0 {
+			b.WriteString("{}\n")
+			return
+		}
+		for i, k := range n.keys {
+			if i > 0 || !inList {
+				b.WriteString(pad)
+			}
+			b.WriteString(yamlString(k) + ":")
+			writeYAMLValue(b, n.vals[i], indent)
+		}
+	case 'l':
+		if len(n.list) == 0 {
+			b.WriteString("[]\n")
+			return
+		}
+		for i, c := range n.list {
+			if i > 0 || !inList {
+				b.WriteString(pad)
+			}
+			b.WriteString("- ")
+			writeYAMLNode(b, c, indent+1, true)
+		}
+	default:
+		b.WriteString(n.scalar + "\n")
+	}
+}
+
+// writeYAMLValue writes the value of a mapping key.
+func writeYAMLValue(b *bytes.Buffer, v *yamlNode, indent int) {
+	if v.kind == 's' || isEmptyYAML(v) {
+		b.WriteString(" ")
+		writeYAMLNode(b, v, indent, false)
+		return
+	}
+	b.WriteString("\n")
+	if v.kind == 'l' {
+		writeYAMLNode(b, v, indent, false) // lists sit at the key's indent
+		return
+	}
+	writeYAMLNode(b, v, indent+1, false)
+}
+
+func isEmptyYAML(n *yamlNode) bool {
+	return (n.kind == 'm' && len(n.keys) == 0) || (n.kind == 'l' && len(n.list) == 0)
+}
@@ -0,0 +1,165 @@
+// overlay.go
+// Copy-on-write sector layer used to stage changes to a volume, print them
+// as a sector-level plan and only then commit them.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// sectorOverlay keeps written sectors in memory on top of a read-only base.
+type sectorOverlay struct {
+	base    io.ReaderAt
+	bps     int64
+	sectors map[int64][]byte
+}
+
+func newSectorOverlay(base io.ReaderAt, bps int64) *sectorOverlay {
+	return &sectorOverlay{base: base, bps: bps, sectors: map[int64][]byte{}}
+}
+
+// sector returns the current contents of sector s, from the overlay or the base.
+func (o *sectorOverlay) sector(s int64) ([]byte, error) {
+	if b, ok := o.sectors[s]; ok {
+		return b, nil
+	}
+	b := make([]byte, o.bps)
+	if _, err := o.base.ReadAt(b, s*o.bps); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (o *sectorOverlay) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		s, within := (off+int64(n))/o.bps, (off+int64(n))%o.bps
+		b, err := o.sector(s)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], b[within:])
+	}
+	return n, nil
+}
+
+func (o *sectorOverlay) WriteAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		s, within := (off+int64(n))/o.bps, (off+int64(n))%o.bps
+		b, err := o.sector(s)
+		if err != nil {
+			return n, err
+		}
+		if _, staged := o.sectors[s]; !staged {
+			b = append([]byte(nil), b...)
+			o.sectors[s] = b
+		}
+		n += copy(b[within:], p[n:])
+	}
+	return n, nil
+}
+
+// sectorChange is one sector whose staged contents differ from the base.
+type sectorChange struct {
+	Sector   int64
+	Old, New []byte
+}
+
+// changes returns the staged sectors that really differ from the base, in order.
+func (o *sectorOverlay) changes() ([]sectorChange, error) {
+	keys := make([]int64, 0, len(o.sectors))
+	for s := range o.sectors {
+		keys = append(keys, s)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	out := []sectorChange{}
+	for _, s := range keys {
+		old := make([]byte, o.bps)
+		if _, err := o.base.ReadAt(old, s*o.bps); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if !bytes.Equal(old, o.sectors[s]) {
+			out = append(out, sectorChange{Sector: s, Old: old, New: o.sectors[s]})
+		}
+	}
+	return out, nil
+}
+
+// commit writes every changed sector to w.
+func (o *sectorOverlay) commit(w io.WriterAt) (int, error) {
+	ch, err := o.changes()
+	if err != nil {
+		return 0, err
+	}
+	for i, c := range ch {
+		if _, err := w.WriteAt(c.New, c.Sector*o.bps); err != nil {
+			return i, fmt.Errorf("write sector %d: %w", c.Sector, err)
+		}
+	}
+	return len(ch), nil
+}
+
+// sectorRole names the part of the volume a sector belongs to.
+func (v *fatVolume) sectorRole(s int64) string {
+	switch {
+	case s == 0:
+		return "boot sector"
+	case v.ft == FAT32 && s == int64(v.g.FSInfoSector):
+		return "FSInfo"
+	case v.ft == FAT32 && v.g.BackupBootSector != 0 && s >= int64(v.g.BackupBootSector) && s < int64(v.g.BackupBootSector)+3:
+		return "backup boot region"
+	case s < int64(v.g.ReservedSectors):
+		return "reserved"
+	case s < v.rootStart():
+		i := (s - int64(v.g.ReservedSectors)) / int64(v.fatSecs)
+		return fmt.Sprintf("FAT #%d", i+1)
+	case s < v.dataStart():
+		return "root directory"
+	default:
+		return fmt.Sprintf("cluster %d", v.sectorCluster(s))
+	}
+}
+
+// printSectorPlan prints each changed sector with a hex diff of the 16-byte
+// rows that change.
+func printSectorPlan(v *fatVolume, ch []sectorChange) {
+	const maxRows = 8
+	for _, c := range ch {
+		diff := 0
+		for i := range c.Old {
+			if c.Old[i] != c.New[i] {
+				diff++
+			}
+		}
+		fmt.Printf("  sector %-8d %-20s %d byte(s) change\n", c.Sector, v.sectorRole(c.Sector), diff)
+		rows := 0
+		for off := 0; off < len(c.Old); off += 16 {
+			if bytes.Equal(c.Old[off:off+16], c.New[off:off+16]) {
+				continue
+			}
+			if rows == maxRows {
+				fmt.Println("      ...")
+				break
+			}
+			fmt.Printf("      %04X  - %s\n", off, hexRow(c.Old[off:off+16]))
+			fmt.Printf("            + %s\n", hexRow(c.New[off:off+16]))
+			rows++
+		}
+	}
+}
+
+func hexRow(b []byte) string {
+	var sb strings.Builder
+	for i, x := range b {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%02x", x)
+	}
+	return sb.String()
+}
@@ -0,0 +1,122 @@
+// probe.go
+// Signature detection: tell what is already on a disk or image from its
+// first sectors, so device listings show what a format would destroy.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// fsSignature is what detectFilesystem found. Type is one of FAT12, FAT16,
+// FAT32, exFAT, NTFS, ext2, ext3, ext4, ISO9660, GPT, MBR, blank or
+// unknown.
+type fsSignature struct {
+	Type   string `json:"type"`
+	Label  string `json:"label,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (s fsSignature) String() string {
+	out := s.Type
+	if s.Label != "" {
+		out += fmt.Sprintf(" %q", s.Label)
+	}
+	if s.Detail != "" {
+		out += " (" + s.Detail + ")"
+	}
+	return out
+}
+
+// probeBytes is how much of the start of a target detectFilesystem reads:
+// enough for the ISO9660 primary volume descriptor at 32 KiB.
+const probeBytes = 36 * 1024
+
+// ext superblock feature bits that tell ext2, ext3 and ext4 apart: a
+// journal makes ext3, any of the ext4 features (extents, 64bit, flex_bg;
+// huge_file, gdt_csum, extra_isize, metadata_csum) makes ext4.
+const (
+	extCompatJournal    = 0x0004
+	extIncompatExt4Mask = 0x0040 | 0x0080 | 0x0200
+	extROCompatExt4Mask = 0x0008 | 0x0010 | 0x0040 | 0x0400
+)
+
+// detectFilesystem looks at the start of r, a disk, partition or image,
+// and reports the file system or partition table on it. A target shorter
+// than the probe is read as far as it goes.
+func detectFilesystem(r io.ReaderAt) fsSignature {
+	buf := make([]byte, probeBytes)
+	n, err := r.ReadAt(buf, 0)
+	if n < 512 {
+		if err == nil || err == io.EOF {
+			return fsSignature{Type: "blank", Detail: "empty"}
+		}
+		return fsSignature{Type: "unknown", Detail: "unreadable"}
+	}
+	buf = buf[:n]
+
+	switch string(buf[3:11]) {
+	case "EXFAT   ":
+		return fsSignature{Type: "exFAT"}
+	case "NTFS    ":
+		return fsSignature{Type: "NTFS"}
+	}
+	if v, err := parseBootSector(buf[:512]); err == nil && (buf[0] == 0xEB || buf[0] == 0xE9) {
+		label := v.label
+		if label == "NO NAME" {
+			label = ""
+		}
+		if ov, err := openFATVolume(r, nil); err == nil {
+			label = ov.volumeLabel()
+		}
+		return fsSignature{Type: fmt.Sprintf("FAT%d", v.ft), Label: label}
+	}
+	if len(buf) >= 32840 && string(buf[32769:32774]) == "CD001" {
+		return fsSignature{Type: "ISO9660", Label: strings.TrimRight(string(buf[32808:32840]), " \x00")}
+	}
+	if len(buf) >= 2048 && binary.LittleEndian.Uint16(buf[1024+56:]) == 0xEF53 {
+		sb := buf[1024:] // the superblock
+		compat := binary.LittleEndian.Uint32(sb[92:])
+		incompat := binary.LittleEndian.Uint32(sb[96:])
+		roCompat := binary.LittleEndian.Uint32(sb[100:])
+		typ := "ext2"
+		switch {
+		case incompat&extIncompatExt4Mask != 0 || roCompat&extROCompatExt4Mask != 0:
+			typ = "ext4"
+		case compat&extCompatJournal != 0:
+			typ = "ext3"
+		}
+		return fsSignature{Type: typ, Label: strings.TrimRight(string(sb[120:136]), "\x00")}
+	}
+	if parts := parseMBR(buf[:512]); parts != nil {
+		for _, p := range parts {
+			if p.Type == fmt.Sprintf("0x%02X", mbrGPTProtective) {
+				return fsSignature{Type: "GPT"}
+			}
+		}
+		if len(parts) > 0 {
+			return fsSignature{Type: "MBR", Detail: fmt.Sprintf("%d partition(s)", len(parts))}
+		}
+	}
+	if len(buf) >= 520 && string(buf[512:520]) == "EFI PART" {
+		return fsSignature{Type: "GPT", Detail: "no protective MBR"}
+	}
+	if bytes.Count(buf, []byte{0}) == len(buf) {
+		return fsSignature{Type: "blank"}
+	}
+	return fsSignature{Type: "unknown"}
+}
+
+// detectFilesystemPath runs detectFilesystem on the image or device at path.
+func detectFilesystemPath(path string) (fsSignature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return fsSignature{}, err
+	}
+	defer f.Close()
+	return detectFilesystem(f), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// formatTestImage formats an in-memory image of size bytes the way the
+// format command does, without the progress UI. Only the part up to the
+// last sector written is returned, so large FAT32 volumes stay small.
+func formatTestImage(t *testing.T, ft FATType, size int64, label string) []byte {
+	t.Helper()
+	g, err := presetForSizeBytes(ft, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fatSecs, rootSecs, _, clusters, err := computeLayout(ft, &g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := buildFormatPlan(ft, g, fatSecs, rootSecs, clusters, size, label, "EARMKFAT", 0x12345678, false)
+	var end int64
+	for _, s := range p.Steps {
+		end = max(end, (s.Start+s.Count)*512)
+	}
+	img := make([]byte, end)
+	for _, s := range p.Steps {
+		if s.Kind == stepWrite {
+			copy(img[s.Start*512:], s.payload())
+		}
+	}
+	return img
+}
+
+// extTestImage returns the start of an ext file system with the given
+// feature flags and label.
+func extTestImage(compat, incompat, roCompat uint32, label string) []byte {
+	img := make([]byte, 4096)
+	sb := img[1024:]
+	binary.LittleEndian.PutUint16(sb[56:], 0xEF53)
+	binary.LittleEndian.PutUint32(sb[92:], compat)
+	binary.LittleEndian.PutUint32(sb[96:], incompat)
+	binary.LittleEndian.PutUint32(sb[100:], roCompat)
+	copy(sb[120:136], label)
+	return img
+}
+
+// mbrTestImage returns a disk start whose MBR holds one partition of type typ.
+func mbrTestImage(typ byte) []byte {
+	img := make([]byte, 4096)
+	e := img[446:]
+	e[4] = typ
+	binary.LittleEndian.PutUint32(e[8:], 1)
+	binary.LittleEndian.PutUint32(e[12:], 0xFFFFFFFF)
+	img[510], img[511] = 0x55, 0xAA
+	return img
+}
+
+func TestDetectFilesystem(t *testing.T) {
+	ntfs := make([]byte, 4096)
+	ntfs[0], ntfs[1], ntfs[2] = 0xEB, 0x52, 0x90
+	copy(ntfs[3:], "NTFS    ")
+	ntfs[510], ntfs[511] = 0x55, 0xAA
+
+	gptOnly := make([]byte, 4096)
+	copy(gptOnly[512:], "EFI PART")
+
+	garbage := bytes.Repeat([]byte{0xA5}, 4096)
+
+	tests := []struct {
+		name  string
+		img   []byte
+		typ   string
+		label string
+	}{
+		{"fat12", formatTestImage(t, FAT12, 1440*1024, "FLOPPY"), "FAT12", "FLOPPY"},
+		{"fat12 no label", formatTestImage(t, FAT12, 720*1024, ""), "FAT12", ""},
+		{"fat16", formatTestImage(t, FAT16, 16<<20, "DATA"), "FAT16", "DATA"},
+		{"fat32", formatTestImage(t, FAT32, 300<<20, "BIG"), "FAT32", "BIG"},
+		{"ext2", extTestImage(0, 0, 0, "boot"), "ext2", "boot"},
+		{"ext3", extTestImage(extCompatJournal, 0, 0, ""), "ext3", ""},
+		{"ext4", extTestImage(extCompatJournal, 0x0040, 0, "root"), "ext4", "root"},
+		{"ntfs", ntfs, "NTFS", ""},
+		{"mbr", mbrTestImage(0x0C), "MBR", ""},
+		{"gpt", mbrTestImage(mbrGPTProtective), "GPT", ""},
+		{"gpt without protective mbr", gptOnly, "GPT", ""},
+		{"blank", make([]byte, 64*1024), "blank", ""},
+		{"empty", nil, "blank", ""},
+		{"unknown", garbage, "unknown", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := detectFilesystem(bytes.NewReader(tt.img))
+			if got.Type != tt.typ || got.Label != tt.label {
+				t.Errorf("detectFilesystem = %+v, want type %q label %q", got, tt.typ, tt.label)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+/* ===================== Headless progress ===================== */
+
+// progressEvent is one event of the --progress=json stream. Event is one
+// of phase_start, phase_end, progress, bad_sector and done.
+type progressEvent struct {
+	Event      string  `json:"event"`
+	Elapsed    float64 `json:"elapsed"` // seconds since the start
+	Phase      string  `json:"phase,omitempty"`
+	Op         string  `json:"op,omitempty"`
+	Written    int64   `json:"written"` // sectors written so far
+	Total      int64   `json:"total"`
+	Rate       float64 `json:"rate,omitempty"`   // bytes per second
+	ETA        float64 `json:"eta,omitempty"`    // seconds
+	Sector     *int64  `json:"sector,omitempty"` // bad_sector events, sector 0 too
+	BadSectors int     `json:"bad_sectors"`
+}
+
+// progressReporter reports progress when there is no full-screen UI: as
+// plain log lines or, with json set, as newline-delimited JSON events. It
+// writes to stderr, so stdout keeps the result. A nil reporter does
+// nothing.
+type progressReporter struct {
+	w       io.Writer
+	json    bool
+	start   time.Time
+	phase   string
+	written int64
+	total   int64
+	bad     int
+	every   int64 // sectors between progress events
+	last    int64 // written count at the last progress event
+	lastPct int64 // last tenth logged in text mode
+}
+
+func newProgressReporter(w io.Writer, asJSON bool, start time.Time, total, every int64) *progressReporter {
+	return &progressReporter{w: w, json: asJSON, start: start, total: total, every: every, last: -every, lastPct: -1}
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func (r *progressReporter) emit(e progressEvent) {
+	e.Elapsed = time.Since(r.start).Seconds()
+	e.Written, e.Total, e.BadSectors = r.written, r.total, r.bad
+	if e.Phase == "" {
+		e.Phase = r.phase
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(r.w, string(b))
+}
+
+func (r *progressReporter) logf(format string, args ...any) {
+	fmt.Fprintf(r.w, "%7.1fs  %s\n", time.Since(r.start).Seconds(), fmt.Sprintf(format, args...))
+}
+
+func (r *progressReporter) phaseStart(phase, op string) {
+	if r == nil {
+		return
+	}
+	r.phase = phase
+	if r.json {
+		r.emit(progressEvent{Event: "phase_start", Op: op})
+		return
+	}
+	r.logf("%s", op)
+}
+
+func (r *progressReporter) phaseEnd(phase, op string) {
+	if r == nil || !r.json {
+		return
+	}
+	r.emit(progressEvent{Event: "phase_end", Phase: phase, Op: op})
+}
+
+// progress reports the sectors written so far. JSON events go out every
+// --ui-every sectors; log lines every tenth of the volume.
+func (r *progressReporter) progress(op string, written int64, rate float64, eta time.Duration) {
+	if r == nil {
+		return
+	}
+	r.written = written
+	if r.json {
+		if written-r.last >= r.every {
+			r.last = written
+			r.emit(progressEvent{Event: "progress", Op: op, Rate: rate, ETA: eta.Seconds()})
+		}
+		return
+	}
+	if r.total <= 0 {
+		return
+	}
+	if pct := written * 10 / r.total; pct > r.lastPct {
+		r.lastPct = pct
+		r.logf("%3d%%  %d / %d sectors  %s/s  ETA %s", pct*10, written, r.total, human(int64(rate)), eta)
+	}
+}
+
+func (r *progressReporter) badSector(sector int64) {
+	if r == nil {
+		return
+	}
+	r.bad++
+	if r.json {
+		r.emit(progressEvent{Event: "bad_sector", Sector: &sector})
+		return
+	}
+	r.logf("bad sector %d", sector)
+}
+
+func (r *progressReporter) done() {
+	if r == nil {
+		return
+	}
+	r.phase = ""
+	if r.json {
+		r.emit(progressEvent{Event: "done"})
+		return
+	}
+	r.logf("done")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestProgressEventSector(t *testing.T) {
+	tests := []struct {
+		name   string
+		report func(r *progressReporter)
+		sector any // nil when the event has no sector
+	}{
+		{"bad sector 0", func(r *progressReporter) { r.badSector(0) }, 0.0},
+		{"bad sector", func(r *progressReporter) { r.badSector(2879) }, 2879.0},
+		{"progress", func(r *progressReporter) { r.progress("Write", 64, 0, 0) }, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.report(newProgressReporter(&buf, true, time.Now(), 2880, 64))
+			var e map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+				t.Fatalf("event does not parse: %v\n%s", err, buf.String())
+			}
+			if e["sector"] != tt.sector {
+				t.Errorf("sector = %v, want %v in %s", e["sector"], tt.sector, buf.String())
+			}
+		})
+	}
+}
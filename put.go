@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+/* ===================== put ===================== */
+
+// putHostFile copies one host file into the directory at cluster parent.
+func putHostFile(v *fatVolume, parent uint32, src, name string, overwrite bool) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("%s: is a directory", src)
+	}
+	if _, err := v.putFile(parent, name, f, st.Size(), stampTime(st.ModTime()), overwrite); err != nil {
+		return err
+	}
+	return nil
+}
+
+// putTarget resolves the destination for copying srcs into the volume. It
+// returns the directory to write into and, for a single source copied to a
+// new name, that name.
+func putTarget(v *fatVolume, dest string, srcs int) (dirEntry, string, error) {
+	e, err := v.lookup(dest)
+	if err == nil {
+		if e.isDir() {
+			return e, "", nil
+		}
+		if srcs > 1 {
+			return dirEntry{}, "", fmt.Errorf("%s: not a directory", dest)
+		}
+	}
+	parts := splitFATPath(dest)
+	if len(parts) == 0 || srcs > 1 || strings.HasSuffix(dest, "/") {
+		return dirEntry{}, "", fmt.Errorf("%s: %w", dest, errNotFound)
+	}
+	parent, err := v.lookup("/" + strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return dirEntry{}, "", err
+	}
+	if !parent.isDir() {
+		return dirEntry{}, "", fmt.Errorf("%s: not a directory", parent.Name)
+	}
+	return parent, parts[len(parts)-1], nil
+}
+
+func newPutCmd() *cobra.Command {
+	var overwrite, parents bool
+	guard := newDeviceGuard()
+	cmd := &cobra.Command{
+		Use:   "put <image|device> <host-file>... <::/dest>",
+		Short: "Copy host files into an existing FAT12/16/32 image or device",
+		Args:  cobra.MinimumNArgs(3),
+		RunE: func(_ *cobra.Command, args []string) (err error) {
+			target, srcs, dest := args[0], args[1:len(args)-1], args[len(args)-1]
+			f, v, err := openVolumeFile(target, true, guard)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			audit := newVolumeAudit("put", target)
+			defer func() { audit.finish(err) }()
+
+			if parents {
+				if _, err := v.mkdirAll(dest, now()); err != nil {
+					return err
+				}
+			}
+			dir, name, err := putTarget(v, dest, len(srcs))
+			if err != nil {
+				return err
+			}
+			for _, src := range srcs {
+				n := name
+				if n == "" {
+					n = filepath.Base(src)
+				}
+				// putFile keeps the FATs on disk in step with every entry it
+				// writes, so the files before a failed one stay as they are.
+				if err := putHostFile(v, dir.Cluster, src, n, overwrite); err != nil {
+					return err
+				}
+				shown := splitFATPath(dest)
+				if name == "" {
+					shown = append(shown, n)
+				}
+				fmt.Printf("%s -> ::/%s\n", src, strings.Join(shown, "/"))
+			}
+			return f.Sync()
+		},
+	}
+	cmd.Flags().BoolVar(&overwrite, "overwrite", false, "replace files that already exist")
+	cmd.Flags().BoolVarP(&parents, "parents", "p", false, "treat the destination as a directory and create it if missing")
+	guard.addInUseFlags(cmd)
+	return cmd
+}
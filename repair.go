@@ -0,0 +1,209 @@
+// repair.go
+// Repair pass of the checker. Every change goes through a sectorOverlay, so
+// the complete sector-level plan can be printed before anything is written.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// repairOptions select how the repair pass treats the volume.
+type repairOptions struct {
+	fatSource int // 1-based FAT copy the other copies are resynced from
+}
+
+// plannedSector summarises one sector of a repair plan for reports.
+type plannedSector struct {
+	Sector int64  `json:"sector"`
+	Role   string `json:"role"`
+	Bytes  int    `json:"bytes_changed"`
+}
+
+// repairVolume fixes what the checker finds on v and describes every action
+// taken. v is expected to write to a sectorOverlay.
+func repairVolume(v *fatVolume, size int64, target string, opt repairOptions) ([]string, error) {
+	actions := []string{}
+
+	// FAT copies: load the chosen source and rewrite every copy from it.
+	if opt.fatSource < 1 || opt.fatSource > int(v.g.NumFATs) {
+		return nil, fmt.Errorf("--fat-source must be between 1 and %d", v.g.NumFATs)
+	}
+	src := make([]byte, len(v.fat))
+	if _, err := v.r.ReadAt(src, v.fatStart(opt.fatSource-1)*v.bps()); err != nil {
+		return nil, fmt.Errorf("read FAT #%d: %w", opt.fatSource, err)
+	}
+	copy(v.fat, src)
+	buf := make([]byte, len(v.fat))
+	for i := 0; i < int(v.g.NumFATs); i++ {
+		if _, err := v.r.ReadAt(buf, v.fatStart(i)*v.bps()); err != nil {
+			return nil, fmt.Errorf("read FAT #%d: %w", i+1, err)
+		}
+		if !bytes.Equal(buf, src) {
+			actions = append(actions, fmt.Sprintf("FAT #%d resynchronised from FAT #%d", i+1, opt.fatSource))
+		}
+	}
+	v.dirty = map[int64]bool{}
+	for s := int64(0); s < int64(v.fatSecs); s++ {
+		v.dirty[s] = true
+	}
+
+	// Cross-links first, then chains that disagree with their sizes; each
+	// pass works on a fresh check of the partly repaired volume.
+	for _, kind := range []string{"cross-link", "size"} {
+		c := runCheck(v, size, target)
+		for _, f := range c.fixes {
+			if f.Kind != kind {
+				continue
+			}
+			a, err := v.truncateEntry(f)
+			if err != nil {
+				return actions, err
+			}
+			actions = append(actions, a)
+		}
+	}
+
+	// Lost chains become FILEnnnn.CHK files in the root directory.
+	c := runCheck(v, size, target)
+	for i, chain := range c.lost {
+		last := chain[len(chain)-1]
+		if !v.isEOC(v.entry(last)) {
+			v.setEntry(last, v.eocMark())
+		}
+		name := v.nextCHKName()
+		bytes := int64(len(chain)) * v.clusterBytes()
+		if bytes > 0xFFFFFFFF {
+			bytes = 0xFFFFFFFF
+		}
+		if _, err := v.createEntry(0, name, attrArchive, chain[0], uint32(bytes), now()); err != nil {
+			actions = append(actions, fmt.Sprintf("%d lost chain(s) not recovered: %v", len(c.lost)-i, err))
+			break
+		}
+		actions = append(actions, fmt.Sprintf("lost chain of %d cluster(s) at %d saved as ::/%s", len(chain), chain[0], name))
+	}
+
+	// Clean-shutdown and no-error bits.
+	if v.ft != FAT12 {
+		clean, noErr := v.fatStatusBits()
+		if x := v.entry(1); x&(clean|noErr) != clean|noErr {
+			v.setEntry(1, x|clean|noErr)
+			actions = append(actions, "clean-shutdown and no-error bits set in FAT[1]")
+		}
+	}
+
+	if v.ft == FAT32 {
+		a, err := v.repairReservedFAT32()
+		if err != nil {
+			return actions, err
+		}
+		actions = append(actions, a...)
+	}
+	if err := v.flush(); err != nil {
+		return actions, err
+	}
+	return actions, nil
+}
+
+// truncateEntry cuts the chain of a damaged entry down to f.Keep clusters
+// and shrinks its size to match.
+func (v *fatVolume) truncateEntry(f chainFix) (string, error) {
+	d, err := v.readDir(f.Dir)
+	if err != nil {
+		return "", err
+	}
+	if f.Keep == 0 && f.IsDir {
+		for i := f.LFNSlot; i <= f.Slot; i++ {
+			if err := v.writeSlots(d, i, append([]byte{0xE5}, d.data[i*32+1:i*32+32]...)); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%s: directory has no usable clusters, entry removed", f.Path), nil
+	}
+	raw := append([]byte(nil), d.data[f.Slot*32:f.Slot*32+32]...)
+	if f.Keep == 0 {
+		binary.LittleEndian.PutUint16(raw[20:], 0)
+		binary.LittleEndian.PutUint16(raw[26:], 0)
+	} else {
+		v.setEntry(f.Chain[f.Keep-1], v.eocMark())
+	}
+	for _, cl := range f.Free {
+		v.setEntry(cl, 0)
+	}
+	size := f.Size
+	if max := int64(f.Keep) * v.clusterBytes(); !f.IsDir && int64(size) > max {
+		size = uint32(max)
+	}
+	binary.LittleEndian.PutUint32(raw[28:], size)
+	if err := v.writeSlots(d, f.Slot, raw); err != nil {
+		return "", err
+	}
+	what := "chain truncated"
+	if f.Kind == "cross-link" {
+		what = fmt.Sprintf("cross-link at cluster %d truncated", f.Chain[f.Keep])
+	}
+	return fmt.Sprintf("%s: %s to %d cluster(s), size %d -> %d", f.Path, what, f.Keep, f.Size, size), nil
+}
+
+// nextCHKName returns the first FILEnnnn.CHK name not used in the root directory.
+func (v *fatVolume) nextCHKName() string {
+	d, err := v.readDir(0)
+	for n := 0; err == nil && n < 10000; n++ {
+		name := fmt.Sprintf("FILE%04d.CHK", n)
+		if _, ok := findEntry(d, name); !ok {
+			return name
+		}
+	}
+	return "FILE9999.CHK"
+}
+
+// repairReservedFAT32 rebuilds damaged FSInfo sectors and refreshes the
+// backup boot sector from sector 0. The FSInfo counters are recomputed by flush.
+func (v *fatVolume) repairReservedFAT32() ([]string, error) {
+	actions := []string{}
+	if fsi := int64(v.g.FSInfoSector); fsi != 0 && fsi < int64(v.g.ReservedSectors) {
+		fs := make([]byte, 512)
+		if _, err := v.r.ReadAt(fs, fsi*v.bps()); err != nil {
+			return nil, err
+		}
+		if !validFSInfo(fs) {
+			if _, err := v.w.WriteAt(buildFSInfo(v.freeClusters(), v.allocHint()), fsi*v.bps()); err != nil {
+				return nil, err
+			}
+			actions = append(actions, "FSInfo sector rebuilt")
+		}
+		if free := binary.LittleEndian.Uint32(fs[488:]); free != v.freeClusters() {
+			actions = append(actions, fmt.Sprintf("FSInfo free count set to %d", v.freeClusters()))
+		}
+	}
+	if bb := int64(v.g.BackupBootSector); bb != 0 && bb < int64(v.g.ReservedSectors) {
+		boot := make([]byte, 512)
+		backup := make([]byte, 512)
+		if _, err := v.r.ReadAt(boot, 0); err != nil {
+			return nil, err
+		}
+		if _, err := v.r.ReadAt(backup, bb*v.bps()); err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(boot, backup) {
+			if _, err := v.w.WriteAt(boot, bb*v.bps()); err != nil {
+				return nil, err
+			}
+			actions = append(actions, fmt.Sprintf("backup boot sector %d refreshed from sector 0", bb))
+		}
+		if fb := bb + int64(v.g.FSInfoSector); v.g.FSInfoSector != 0 && fb < int64(v.g.ReservedSectors) {
+			fs := make([]byte, 512)
+			if _, err := v.r.ReadAt(fs, fb*v.bps()); err != nil {
+				return nil, err
+			}
+			if !validFSInfo(fs) {
+				if _, err := v.w.WriteAt(buildFSInfo(v.freeClusters(), v.allocHint()), fb*v.bps()); err != nil {
+					return nil, err
+				}
+				actions = append(actions, fmt.Sprintf("backup FSInfo sector %d rebuilt", fb))
+			}
+		}
+	}
+	return actions, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memImage is an in-memory image that reads and writes like a file.
+type memImage []byte
+
+func (m memImage) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m memImage) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(m)) {
+		return 0, errors.New("write past the end of the image")
+	}
+	return copy(m[off:], p), nil
+}
+
+var testMod = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// testContent returns n bytes of a pattern that differs per seed.
+func testContent(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = seed + byte(i%251)
+	}
+	return b
+}
+
+// testVolume formats an in-memory image of size bytes and stores A.TXT and
+// B.TXT of three clusters each in its root directory.
+func testVolume(t *testing.T, ft FATType, size int64) (memImage, *fatVolume) {
+	t.Helper()
+	img := formatTestImage(t, ft, size, "TEST")
+	img = append(img, make([]byte, size-int64(len(img)))...)
+	m := memImage(img)
+	v, err := openFATVolume(m, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"A.TXT", "B.TXT"} {
+		data := testContent(3*int(v.clusterBytes()), byte(i))
+		if _, err := v.putFile(0, name, bytes.NewReader(data), int64(len(data)), testMod, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m, v
+}
+
+// testChain returns the entry and the cluster chain of a root directory file.
+func testChain(t *testing.T, v *fatVolume, name string) (dirEntry, []uint32) {
+	t.Helper()
+	e, err := v.lookup("::/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := v.chain(e.Cluster)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, chain
+}
+
+// recheck opens img afresh and fails the test if the checker finds errors.
+func recheck(t *testing.T, img memImage) *fatVolume {
+	t.Helper()
+	v, err := openFATVolume(img, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := runCheck(v, int64(len(img)), "test"); c.rep.Errors > 0 {
+		t.Errorf("re-check finds %d error(s): %+v", c.rep.Errors, c.rep.Issues)
+	}
+	return v
+}
+
+func TestRepair(t *testing.T) {
+	tests := []struct {
+		name   string
+		ft     FATType
+		size   int64
+		damage func(t *testing.T, img memImage, v *fatVolume)
+		issue  string // code the checker reports
+		action string // part of a repair action
+	}{
+		{"cross-link", FAT12, 1440 * 1024, func(t *testing.T, img memImage, v *fatVolume) {
+			_, a := testChain(t, v, "A.TXT")
+			_, b := testChain(t, v, "B.TXT")
+			v.setEntry(a[1], b[1])
+			if err := v.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}, "cross-link", "cross-link at cluster"},
+		{"size mismatch", FAT12, 1440 * 1024, func(t *testing.T, img memImage, v *fatVolume) {
+			e, _ := testChain(t, v, "A.TXT")
+			d, err := v.readDir(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw := append([]byte(nil), d.data[e.Slot*32:e.Slot*32+32]...)
+			binary.LittleEndian.PutUint32(raw[28:], 1)
+			if err := v.writeSlots(d, e.Slot, raw); err != nil {
+				t.Fatal(err)
+			}
+		}, "size-mismatch", "chain truncated to 1 cluster(s)"},
+		{"lost chain", FAT16, 16 << 20, func(t *testing.T, img memImage, v *fatVolume) {
+			if _, err := v.allocChain(2); err != nil {
+				t.Fatal(err)
+			}
+			if err := v.flush(); err != nil {
+				t.Fatal(err)
+			}
+		}, "lost-clusters", "saved as ::/FILE0000.CHK"},
+		{"FAT mismatch", FAT16, 16 << 20, func(t *testing.T, img memImage, v *fatVolume) {
+			_, a := testChain(t, v, "A.TXT")
+			off := v.fatStart(1)*v.bps() + int64(a[0])*2
+			binary.LittleEndian.PutUint16(img[off:], 0)
+		}, "fat-mismatch", "FAT #2 resynchronised from FAT #1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, v := testVolume(t, tt.ft, tt.size)
+			tt.damage(t, img, v)
+
+			v, err := openFATVolume(img, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := runCheck(v, int64(len(img)), "test")
+			var found bool
+			for _, is := range c.rep.Issues {
+				found = found || is.Code == tt.issue
+			}
+			if c.rep.Errors == 0 || !found {
+				t.Fatalf("check finds %d error(s), want a %s issue: %+v", c.rep.Errors, tt.issue, c.rep.Issues)
+			}
+
+			// As check --repair does: plan on an overlay, then commit it.
+			ov := newSectorOverlay(img, v.bps())
+			rv, err := openFATVolume(ov, ov)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actions, err := repairVolume(rv, int64(len(img)), "test", repairOptions{fatSource: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(strings.Join(actions, "\n"), tt.action) {
+				t.Errorf("repair plan %q, want an action containing %q", actions, tt.action)
+			}
+			if after := runCheck(rv, int64(len(img)), "test"); after.rep.Errors > 0 {
+				t.Errorf("planned repair leaves %d error(s): %+v", after.rep.Errors, after.rep.Issues)
+			}
+			if _, err := ov.commit(img); err != nil {
+				t.Fatal(err)
+			}
+			recheck(t, img)
+		})
+	}
+}
+
+func TestPutOverwrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		clusters int // size of the new A.TXT, in clusters
+		extra    int // bytes past the last whole cluster
+	}{
+		{"shrink", 1, 1},
+		{"same size", 3, 0},
+		{"grow", 5, 100},
+		{"empty", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			img, v := testVolume(t, FAT12, 1440*1024)
+			free := v.freeClusters()
+			data := testContent(tt.clusters*int(v.clusterBytes())+tt.extra, 7)
+			if _, err := v.putFile(0, "A.TXT", bytes.NewReader(data), int64(len(data)), testMod, false); err == nil {
+				t.Fatal("putFile without overwrite replaced an existing file")
+			}
+			if _, err := v.putFile(0, "A.TXT", bytes.NewReader(data), int64(len(data)), testMod, true); err != nil {
+				t.Fatal(err)
+			}
+
+			v = recheck(t, img)
+			if got, want := v.freeClusters(), free+3-uint32(v.clustersFor(int64(len(data)))); got != want {
+				t.Errorf("%d free clusters, want %d", got, want)
+			}
+			e, _ := testChain(t, v, "A.TXT")
+			var got bytes.Buffer
+			if _, damage, err := v.readFile(e, &got); err != nil || damage != "" {
+				t.Fatalf("readFile: %v %s", err, damage)
+			}
+			if !bytes.Equal(got.Bytes(), data) {
+				t.Errorf("A.TXT holds %d bytes that differ from the %d put", got.Len(), len(data))
+			}
+			if _, b := testChain(t, v, "B.TXT"); len(b) != 3 {
+				t.Errorf("B.TXT has %d clusters, want 3", len(b))
+			}
+		})
+	}
+}
@@ -53,6 +53,16 @@ func NewUI() (*UI, error) {
 	return u, nil
 }
 
+// NewHeadless creates a UI without a terminal, for when none is available.
+// Everything displayed is discarded; stop requests still work, so callers
+// can use the same code with or without a screen.
+func NewHeadless() *UI {
+	return &UI{
+		stopChan:     make(chan struct{}),
+		phaseDoneMap: make(map[string]bool),
+	}
+}
+
 // Close closes the UI and restores the terminal to its original state.
 func (u *UI) Close() {
 	if u.s == nil {
@@ -68,7 +78,9 @@ func (u *UI) Close() {
 func (u *UI) RequestStop() {
 	u.once.Do(func() {
 		close(u.stopChan)
-		u.s.PostEvent(tcell.NewEventInterrupt(nil))
+		if u.s != nil {
+			u.s.PostEvent(tcell.NewEventInterrupt(nil))
+		}
 	})
 }
 
@@ -105,6 +117,9 @@ func putStr(s tcell.Screen, x, y int, str string) {
 // LayoutAndDraw redraws the entire UI with the current state.
 // It should be called whenever the displayed information needs to be updated.
 func (u *UI) LayoutAndDraw() {
+	if u.s == nil {
+		return
+	}
 	u.s.Clear()
 	w, h := u.s.Size()
 
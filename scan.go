@@ -0,0 +1,554 @@
+// scan.go
+// Surface scan: reads, or writes and verifies test patterns on, every sector
+// of a disk or image, showing progress on the retrodfrg map, and grades the
+// media. The bad sector report can be fed to format --badblocks.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"mkfat/retrodfrg"
+)
+
+// Per-cell states shown on the scan map; the highest state in a cell wins.
+const (
+	scPending byte = iota
+	scGood
+	scBad
+	scRead
+	scWrite
+)
+
+var scGlyphs = [...]rune{scPending: '░', scGood: '█', scBad: 'B', scRead: 'r', scWrite: 'W'}
+
+// Exit codes of the scan command. Failures to run exit with 2.
+const (
+	scanExitGood     = 0 // no bad sectors
+	scanExitBad      = 1 // bad sectors, but only where a format can mark them
+	scanExitUnusable = 4 // bad sectors in the system area of a default format
+)
+
+// defaultScanPatterns are the destructive test patterns used when none are
+// given, the same sequence as badblocks -w.
+const defaultScanPatterns = "0xAA,0x55,0xFF,0x00"
+
+// scanPattern is one destructive test pattern: a fill byte, or seeded
+// pseudo-random data that can be regenerated per sector for the verify.
+type scanPattern struct {
+	b      byte
+	random bool
+	seed   uint64
+}
+
+func (p scanPattern) String() string {
+	if p.random {
+		return fmt.Sprintf("random:%d", p.seed)
+	}
+	return fmt.Sprintf("0x%02X", p.b)
+}
+
+// parseScanPatterns parses a comma-separated list of fill bytes and
+// "random[:SEED]". A random pattern without a seed gets one from the clock,
+// which is fixed in reproducible mode.
+func parseScanPatterns(s string) ([]scanPattern, error) {
+	var out []scanPattern
+	for _, f := range strings.Split(s, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		switch {
+		case f == "":
+			continue
+		case f == "random" || strings.HasPrefix(f, "random:"):
+			p := scanPattern{random: true, seed: uint64(now().UnixNano())}
+			if seed, ok := strings.CutPrefix(f, "random:"); ok {
+				n, err := strconv.ParseUint(seed, 0, 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid random seed %q", seed)
+				}
+				p.seed = n
+			}
+			out = append(out, p)
+		default:
+			n, err := strconv.ParseUint(f, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q (want a byte such as 0xF6, or random[:SEED])", f)
+			}
+			out = append(out, scanPattern{b: byte(n)})
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no test patterns given")
+	}
+	return out, nil
+}
+
+// fill writes the pattern for sector into buf, one 512-byte sector.
+func (p scanPattern) fill(buf []byte, sector int64) {
+	if !p.random {
+		for i := range buf {
+			buf[i] = p.b
+		}
+		return
+	}
+	// splitmix64, keyed on seed and sector so any sector can be regenerated
+	x := p.seed ^ uint64(sector)*0x9E3779B97F4A7C15
+	for i := 0; i+8 <= len(buf); i += 8 {
+		x += 0x9E3779B97F4A7C15
+		z := x
+		z = (z ^ z>>30) * 0xBF58476D1CE4E5B9
+		z = (z ^ z>>27) * 0x94D049BB133111EB
+		z ^= z >> 31
+		for k := 0; k < 8; k++ {
+			buf[i+k] = byte(z >> (8 * k))
+		}
+	}
+}
+
+// scanGeometry returns the sectors per track and the number of leading
+// sectors (boot sector, FATs, root directory) of a default format of size.
+// Bad sectors in that system area make the media unusable for FAT.
+func scanGeometry(size int64) (spt int64, system int64) {
+	for _, ft := range []FATType{FAT12, FAT16, FAT32} {
+		g, err := presetForSizeBytes(ft, size)
+		if err != nil {
+			continue
+		}
+		fatSecs, rootSecs, _, _, err := computeLayout(ft, &g)
+		if err != nil {
+			continue
+		}
+		system = int64(g.ReservedSectors) + int64(g.NumFATs)*int64(fatSecs) + int64(rootSecs)
+		if ft == FAT32 {
+			system += int64(g.SectorsPerCluster) // root directory cluster
+		}
+		return int64(g.SectorsPerTrack), system
+	}
+	return 64, 1
+}
+
+// scanner runs the scan passes and keeps the results. I/O goes a track at
+// a time; a track that fails is retried sector by sector to find the bad
+// ones.
+type scanner struct {
+	f        *os.File
+	path     string
+	sectors  int64
+	chunk    int64
+	system   int64
+	write    bool
+	patterns []scanPattern
+	passes   int
+
+	bad map[int64]string // first failure of each bad sector
+
+	ui       *retrodfrg.UI
+	stop     chan struct{}
+	start    time.Time
+	lastDraw time.Time
+	op       string
+	pass     int
+	pos      int64 // next sector of the current phase
+	cur      byte  // scRead or scWrite
+	bytes    int64 // bytes transferred, for the rate
+}
+
+func (s *scanner) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return s.ui != nil && s.ui.IsStopped()
+	}
+}
+
+func (s *scanner) markBad(sector int64, why string) {
+	if _, ok := s.bad[sector]; !ok {
+		s.bad[sector] = why
+	}
+}
+
+// badList returns the bad sectors in order.
+func (s *scanner) badList() []int64 {
+	out := make([]int64, 0, len(s.bad))
+	for sec := range s.bad {
+		out = append(out, sec)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out
+}
+
+// run performs every pass. In write mode each pattern is first written over
+// the whole surface and only then read back, so address faults that make
+// two sectors share storage are caught too.
+func (s *scanner) run() error {
+	buf := make([]byte, s.chunk*512)
+	for s.pass = 1; s.pass <= s.passes; s.pass++ {
+		if !s.write {
+			if err := s.phase("read", scRead, func(start, n int64) error {
+				return s.readChunk(buf[:n*512], start, nil)
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, p := range s.patterns {
+			if err := s.phase("write "+p.String(), scWrite, func(start, n int64) error {
+				return s.writeChunk(buf[:n*512], start, p)
+			}); err != nil {
+				return err
+			}
+			if err := dropCache(s.f); err != nil {
+				return err
+			}
+			if err := s.phase("verify "+p.String(), scRead, func(start, n int64) error {
+				return s.readChunk(buf[:n*512], start, &p)
+			}); err != nil {
+				return err
+			}
+			if s.pass == s.passes && s.ui != nil {
+				s.ui.SetPhaseDone(p.String())
+			}
+		}
+	}
+	if !s.write && s.ui != nil {
+		s.ui.SetPhaseDone("read")
+	}
+	s.draw(true)
+	return nil
+}
+
+// phase applies do to the whole surface, a chunk at a time.
+func (s *scanner) phase(op string, cur byte, do func(start, n int64) error) error {
+	s.op = fmt.Sprintf("pass %d/%d: %s", s.pass, s.passes, op)
+	s.cur = cur
+	for s.pos = 0; s.pos < s.sectors; {
+		if s.stopped() {
+			return retrodfrg.ErrInterrupted
+		}
+		s.draw(false)
+		n := min(s.chunk-s.pos%s.chunk, s.sectors-s.pos) // stay track aligned
+		if err := do(s.pos, n); err != nil {
+			return err
+		}
+		s.pos += n
+		s.bytes += n * 512
+	}
+	return nil
+}
+
+// readChunk reads sectors from start into buf and, when want is set,
+// compares them with the pattern.
+func (s *scanner) readChunk(buf []byte, start int64, want *scanPattern) error {
+	if _, err := s.f.ReadAt(buf, start*512); err != nil {
+		for i := int64(0); i < int64(len(buf))/512; i++ {
+			if _, err := s.f.ReadAt(buf[i*512:(i+1)*512], (start+i)*512); err != nil {
+				s.markBad(start+i, fmt.Sprintf("read error in pass %d", s.pass))
+			}
+		}
+	}
+	if want == nil {
+		return nil
+	}
+	exp := make([]byte, 512)
+	for i := int64(0); i < int64(len(buf))/512; i++ {
+		if _, ok := s.bad[start+i]; ok {
+			continue
+		}
+		want.fill(exp, start+i)
+		if !bytes.Equal(buf[i*512:(i+1)*512], exp) {
+			s.markBad(start+i, fmt.Sprintf("verify failed in pass %d, pattern %s", s.pass, want))
+		}
+	}
+	return nil
+}
+
+// writeChunk writes the pattern over n sectors from start.
+func (s *scanner) writeChunk(buf []byte, start int64, p scanPattern) error {
+	n := int64(len(buf)) / 512
+	for i := int64(0); i < n; i++ {
+		p.fill(buf[i*512:(i+1)*512], start+i)
+	}
+	if _, err := s.f.WriteAt(buf, start*512); err != nil {
+		for i := int64(0); i < n; i++ {
+			if _, err := s.f.WriteAt(buf[i*512:(i+1)*512], (start+i)*512); err != nil {
+				s.markBad(start+i, fmt.Sprintf("write error in pass %d, pattern %s", s.pass, p))
+			}
+		}
+	}
+	return nil
+}
+
+// grade rates the media from the bad sectors found.
+func (s *scanner) grade() (string, int) {
+	bad := s.badList()
+	switch {
+	case len(bad) == 0:
+		return "GOOD: no bad sectors", scanExitGood
+	case bad[0] < s.system:
+		return fmt.Sprintf("UNUSABLE: bad sector %d is in the system area (sectors 0-%d)", bad[0], s.system-1), scanExitUnusable
+	default:
+		return fmt.Sprintf("MARGINAL: %d bad sector(s); format with --badblocks to lock them out", len(bad)), scanExitBad
+	}
+}
+
+// writeReport writes the results as a bad block list: the details go in
+// comments, so format --badblocks reads the file as is.
+func (s *scanner) writeReport(path string, interrupted bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	mode := "read-only"
+	if s.write {
+		names := make([]string, len(s.patterns))
+		for i, p := range s.patterns {
+			names[i] = p.String()
+		}
+		mode = "write, patterns " + strings.Join(names, " ")
+	}
+	grade, _ := s.grade()
+	fmt.Fprintf(w, "# mkfat scan report\n")
+	fmt.Fprintf(w, "# target:  %s, %d sectors of 512 bytes (%s)\n", s.path, s.sectors, human(s.sectors*512))
+	fmt.Fprintf(w, "# mode:    %s, %d pass(es)\n", mode, s.passes)
+	fmt.Fprintf(w, "# started: %s, took %s\n", s.start.Format(time.RFC3339), time.Since(s.start).Truncate(time.Second))
+	if interrupted {
+		fmt.Fprintf(w, "# INTERRUPTED in %s at sector %d; the results are incomplete\n", s.op, s.pos)
+	}
+	fmt.Fprintf(w, "# result:  %s\n", grade)
+	fmt.Fprintf(w, "# bad sectors follow, absolute 512-byte sector numbers\n")
+	for _, sec := range s.badList() {
+		fmt.Fprintf(w, "%d # %s\n", sec, s.bad[sec])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+/* ===================== Display ===================== */
+
+func (s *scanner) draw(force bool) {
+	if s.ui == nil || (!force && time.Since(s.lastDraw) < 40*time.Millisecond) {
+		return
+	}
+	s.lastDraw = time.Now()
+	w, h := s.ui.Size()
+	rows := h - 11 // title, summary, legend, phase and status blocks
+	if w <= 0 || rows < 1 {
+		return
+	}
+	cells := int64(w) * int64(rows)
+	per := (s.sectors + cells - 1) / cells
+	if per < 1 {
+		per = 1
+	}
+	n := (s.sectors + per - 1) / per
+	state := make([]byte, n)
+	for i := range state {
+		lo, hi := int64(i)*per, int64(i+1)*per
+		switch {
+		case hi <= s.pos:
+			state[i] = scGood
+		case lo <= s.pos:
+			state[i] = s.cur
+		}
+	}
+	for sec := range s.bad {
+		state[sec/per] = max(state[sec/per], scBad)
+	}
+	lines := []string{}
+	var b strings.Builder
+	for i, st := range state {
+		b.WriteRune(scGlyphs[st])
+		if i%w == w-1 {
+			lines = append(lines, b.String())
+			b.Reset()
+		}
+	}
+	if b.Len() > 0 {
+		lines = append(lines, b.String())
+	}
+	elapsed := time.Since(s.start)
+	rate := float64(s.bytes) / 1024 / max(elapsed.Seconds(), 0.001)
+	s.ui.SetProgressMap(lines)
+	s.ui.SetSummaryLines([]string{
+		fmt.Sprintf("%d sectors (%s)  Track: %d sectors  System area: sectors 0-%d", s.sectors, human(s.sectors*512), s.chunk, s.system-1),
+		fmt.Sprintf("Each block is %d sector(s)", per),
+	})
+	s.ui.SetStatusLines([]string{
+		fmt.Sprintf("Sector: %d / %d   Bad sectors: %d", s.pos, s.sectors, len(s.bad)),
+		fmt.Sprintf("Elapsed: %s   Rate: %.1f KiB/s", elapsed.Truncate(time.Second), rate),
+		"Current op: " + s.op,
+	})
+	s.ui.LayoutAndDraw()
+}
+
+func newScanCmd() *cobra.Command {
+	var (
+		write    bool
+		force    bool
+		yes      bool
+		patterns string
+		passes   int
+		report   string
+		guard    = newDeviceGuard()
+	)
+	cmd := &cobra.Command{
+		Use:   "scan <image|device>",
+		Short: "Surface-scan a disk or image for bad sectors",
+		Long: "Read every sector of a disk or image, or with --write fill it with test\n" +
+			"patterns and read each one back, and grade the media. --write destroys all\n" +
+			"data on the target, so it asks for the target's name first unless --force\n" +
+			"or --yes is given. The --report file lists the bad sectors in the format\n" +
+			"read by \"mkfat format --badblocks\".\n\n" +
+			"Exit status: 0 no bad sectors, 1 bad sectors a format can lock out,\n" +
+			"4 bad sectors in the system area (unusable), 2 the scan could not run.",
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if passes < 1 {
+				return errors.New("--passes must be at least 1")
+			}
+			if cmd.Flags().Changed("patterns") && !write {
+				return errors.New("--patterns needs --write")
+			}
+			pats, err := parseScanPatterns(patterns)
+			if err != nil {
+				return err
+			}
+			if write {
+				if err := guard.check(args[0]); err != nil {
+					return err
+				}
+				if !force && !yes {
+					if err := confirmDevice(guard.identify(args[0]), "overwrite", os.Stdin, os.Stderr); err != nil {
+						return err
+					}
+				}
+			}
+			var audit *auditEntry
+			if write {
+				audit = newAuditEntry("scan", args[0])
+				audit.identify(guard, args[0])
+			}
+			flag := os.O_RDONLY
+			if write {
+				flag = os.O_RDWR
+			}
+			f, err := os.OpenFile(args[0], flag, 0)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			size, err := getDeviceSize(f)
+			if err != nil {
+				return err
+			}
+			if size < 512 {
+				return fmt.Errorf("%s is smaller than one sector", args[0])
+			}
+			spt, system := scanGeometry(size)
+			s := &scanner{
+				f:        f,
+				path:     args[0],
+				sectors:  size / 512,
+				chunk:    spt,
+				system:   system,
+				write:    write,
+				patterns: pats,
+				passes:   passes,
+				bad:      map[int64]string{},
+				stop:     make(chan struct{}),
+				start:    time.Now(),
+			}
+
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sigChan)
+			go func() {
+				if _, ok := <-sigChan; ok {
+					close(s.stop)
+				}
+			}()
+
+			if ui, err := retrodfrg.NewUI(); err == nil {
+				s.ui = ui
+				mode := "READ-ONLY"
+				phases := []string{"read"}
+				if write {
+					mode = "WRITE"
+					phases = phases[:0]
+					for _, p := range pats {
+						phases = append(phases, p.String())
+					}
+				}
+				ui.SetTitle(fmt.Sprintf("SURFACE SCAN (%s) – %s", mode, args[0]))
+				ui.SetLegend([]string{
+					"Legend:  █ good   ░ not yet scanned   r reading   W writing   B bad | Q to stop",
+				})
+				ui.SetPhases(phases)
+			}
+			err = s.run()
+			if s.ui != nil {
+				s.ui.Close()
+			}
+			if audit != nil {
+				audit.BadSectors = len(s.bad)
+				audit.finish(err)
+			}
+			interrupted := errors.Is(err, retrodfrg.ErrInterrupted)
+			if err != nil && !interrupted {
+				return err
+			}
+			if interrupted {
+				fmt.Printf("Stopped in %s at sector %d; the results are incomplete.\n", s.op, s.pos)
+			}
+			bad := s.badList()
+			fmt.Printf("Scanned %d sectors (%s), %d pass(es), in %s\n", s.sectors, human(s.sectors*512), s.passes, time.Since(s.start).Truncate(time.Millisecond))
+			if len(bad) > 0 {
+				const show = 20
+				list := make([]string, 0, show)
+				for _, sec := range bad[:min(len(bad), show)] {
+					list = append(list, strconv.FormatInt(sec, 10))
+				}
+				more := ""
+				if len(bad) > show {
+					more = fmt.Sprintf(" ... (%d more)", len(bad)-show)
+				}
+				fmt.Printf("Bad sectors: %s%s\n", strings.Join(list, " "), more)
+			}
+			grade, code := s.grade()
+			fmt.Println("Result: " + grade)
+			if report != "" {
+				if err := s.writeReport(report, interrupted); err != nil {
+					return fmt.Errorf("--report: %w", err)
+				}
+				fmt.Printf("Report written to %s\n", report)
+			}
+			if code != scanExitGood {
+				return &exitCodeError{code: code}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&write, "write", false, "destructive test: write each pattern and read it back (erases the target)")
+	cmd.Flags().BoolVar(&force, "force", false, "do not ask before --write destroys the target")
+	cmd.Flags().BoolVar(&yes, "yes", false, "same as --force, for scripts")
+	cmd.Flags().StringVar(&patterns, "patterns", defaultScanPatterns, "comma-separated test patterns for --write: bytes such as 0xF6, or random[:SEED]")
+	cmd.Flags().IntVar(&passes, "passes", 1, "number of times to repeat the scan")
+	cmd.Flags().StringVar(&report, "report", "", "write the bad sector report to this file (readable by format --badblocks)")
+	guard.addFlags(cmd)
+	return cmd
+}
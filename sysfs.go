@@ -0,0 +1,224 @@
+// sysfs.go
+// Linux block device discovery from /sys/class/block. Every function takes
+// the sysfs root, so discovery can run against a fixture tree.
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// blockDevice is what sysfs tells about a block device.
+type blockDevice struct {
+	Name               string   `json:"name"`
+	Size               int64    `json:"size"` // bytes
+	LogicalSectorSize  int      `json:"logical_sector_size"`
+	PhysicalSectorSize int      `json:"physical_sector_size"`
+	Removable          bool     `json:"removable"`
+	ReadOnly           bool     `json:"read_only"`
+	Model              string   `json:"model,omitempty"`
+	Vendor             string   `json:"vendor,omitempty"`
+	Serial             string   `json:"serial,omitempty"`
+	Transport          string   `json:"transport,omitempty"` // usb, sata, nvme, mmc, virtio, floppy, virtual, ...
+	Partition          bool     `json:"partition"`
+	Parent             string   `json:"parent,omitempty"` // disk of a partition
+	Partitions         []string `json:"partitions,omitempty"`
+	Holders            []string `json:"holders,omitempty"`
+}
+
+// readSysfsBlock reads the device name from root/class/block.
+func readSysfsBlock(root, name string) (*blockDevice, error) {
+	link := filepath.Join(root, "class", "block", name)
+	dir, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return nil, err
+	}
+	b := &blockDevice{Name: name}
+	disk := dir
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		b.Partition = true
+		disk = filepath.Dir(dir)
+		b.Parent = filepath.Base(disk)
+	}
+	if n, err := strconv.ParseInt(readSysfs(dir, "size"), 10, 64); err == nil {
+		b.Size = n * 512 // sysfs counts 512-byte units whatever the sector size
+	}
+	b.LogicalSectorSize, _ = strconv.Atoi(readSysfs(disk, "queue/logical_block_size"))
+	b.PhysicalSectorSize, _ = strconv.Atoi(readSysfs(disk, "queue/physical_block_size"))
+	b.Removable = readSysfs(disk, "removable") == "1"
+	b.ReadOnly = readSysfs(dir, "ro") == "1"
+	b.Model = readSysfs(disk, "device/model")
+	b.Vendor = readSysfs(disk, "device/vendor")
+	b.Serial = sysfsSerial(disk)
+	b.Transport = sysfsTransport(disk, b.Name)
+	b.Holders = sysfsList(filepath.Join(dir, "holders"), nil)
+	if !b.Partition {
+		b.Partitions = sysfsList(dir, func(e string) bool {
+			_, err := os.Stat(filepath.Join(dir, e, "partition"))
+			return err == nil
+		})
+	}
+	return b, nil
+}
+
+// discoverSysfs reads every block device under root/class/block, sorted by
+// name.
+func discoverSysfs(root string) ([]*blockDevice, error) {
+	entries, err := os.ReadDir(filepath.Join(root, "class", "block"))
+	if err != nil {
+		return nil, err
+	}
+	var devs []*blockDevice
+	for _, e := range entries {
+		if b, err := readSysfsBlock(root, e.Name()); err == nil {
+			devs = append(devs, b)
+		}
+	}
+	sort.Slice(devs, func(i, j int) bool { return devs[i].Name < devs[j].Name })
+	return devs, nil
+}
+
+// sysfsSerial returns the serial of the disk at dir. USB disks keep it on
+// the USB device, a few levels above the SCSI device.
+func sysfsSerial(dir string) string {
+	if s := readSysfs(dir, "device/serial"); s != "" {
+		return s
+	}
+	if s := readSysfs(dir, "serial"); s != "" {
+		return s // nvme, mmc
+	}
+	d, err := filepath.EvalSymlinks(filepath.Join(dir, "device"))
+	if err != nil {
+		return ""
+	}
+	for i := 0; i < 6; i++ {
+		if s := readSysfs(d, "serial"); s != "" {
+			return s
+		}
+		d = filepath.Dir(d)
+	}
+	return ""
+}
+
+// sysfsTransport guesses the bus from the device path, as lsblk does.
+func sysfsTransport(dir, name string) string {
+	p := filepath.ToSlash(dir)
+	switch {
+	case strings.Contains(p, "/devices/virtual/"):
+		return "virtual"
+	case strings.Contains(p, "/usb"):
+		return "usb"
+	case strings.Contains(p, "/nvme"):
+		return "nvme"
+	case strings.Contains(p, "/mmc"):
+		return "mmc"
+	case strings.Contains(p, "/virtio"):
+		return "virtio"
+	case strings.Contains(p, "/ata"):
+		return "sata"
+	case strings.HasPrefix(name, "fd"):
+		return "floppy"
+	case strings.Contains(p, "/host"):
+		return "scsi"
+	}
+	return ""
+}
+
+// sysfsList returns the names in dir that keep accepts (all when nil).
+func sysfsList(dir string, keep func(string) bool) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if keep == nil || keep(e.Name()) {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// blockCompatible says whether b can be used with --device, and why not.
+func blockCompatible(b *blockDevice) (bool, string) {
+	switch {
+	case b.Partition:
+		return false, "partition of " + b.Parent
+	case b.ReadOnly:
+		return false, "read-only"
+	case strings.HasPrefix(b.Name, "sr"):
+		return false, "optical drive"
+	case strings.HasPrefix(b.Name, "ram") || strings.HasPrefix(b.Name, "zram"):
+		return false, "RAM disk"
+	case strings.HasPrefix(b.Name, "dm-") || strings.HasPrefix(b.Name, "md"):
+		return false, "device-mapper or RAID volume"
+	case b.Size == 0 && strings.HasPrefix(b.Name, "loop"):
+		return false, "unused loop device"
+	case b.Size == 0:
+		return false, "no medium"
+	case len(b.Holders) > 0:
+		return false, "in use by " + strings.Join(b.Holders, ", ")
+	}
+	return true, ""
+}
+
+// blockDeviceInfos turns the devices under root into the device listing.
+func blockDeviceInfos(root string) ([]deviceInfo, error) {
+	devs, err := discoverSysfs(root)
+	if err != nil {
+		return nil, err
+	}
+	infos := []deviceInfo{}
+	for _, b := range devs {
+		ok, reason := blockCompatible(b)
+		// "!" stands for "/" in sysfs names, e.g. cciss!c0d0.
+		path := filepath.Join("/dev", strings.ReplaceAll(b.Name, "!", "/"))
+		infos = append(infos, deviceInfo{Path: path, Compatible: ok, Reason: reason, Block: b})
+	}
+	return infos, nil
+}
+
+// filterDevices keeps the devices that are removable (when removable is
+// set) and no larger than maxSize (when it is not 0). The filters need what
+// sysfs knows, so they only apply on Linux; elsewhere nothing is known to
+// be removable.
+func filterDevices(all []deviceInfo, removable bool, maxSize int64) []deviceInfo {
+	out := []deviceInfo{}
+	for _, d := range all {
+		if removable && (d.Block == nil || !d.Block.Removable) {
+			continue
+		}
+		if maxSize > 0 && (d.Block == nil || d.Block.Size > maxSize) {
+			continue
+		}
+		out = append(out, d)
+	}
+	return out
+}
+
+// blockDeviceDetails returns the type, serial and size columns of the
+// device listing, like getDeviceDetails but from what sysfs reported.
+func blockDeviceDetails(b *blockDevice) (string, string, string) {
+	dtype := "Fixed Disk"
+	if b.Removable {
+		dtype = "Removable Disk"
+	}
+	switch {
+	case mediaTypeBySize(b.Size) != "" || b.Transport == "floppy":
+		dtype = "Floppy"
+	case b.Transport == "usb":
+		dtype = "USB Disk"
+	case b.Transport == "mmc":
+		dtype = "SD/MMC Card"
+	case strings.HasPrefix(b.Name, "loop"):
+		dtype = "Loop"
+	}
+	serial := b.Serial
+	if serial == "" {
+		serial = "-"
+	}
+	return dtype, serial, human(b.Size)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testSysfs builds a sysfs tree with an internal SATA disk and its
+// partition, a USB stick whose serial sits on the USB device, an SD card
+// held by dm-crypt, a floppy drive, an optical drive and an unused loop
+// device.
+func testSysfs(t *testing.T) *sysfsFixture {
+	t.Helper()
+	f := newSysfsFixture(t)
+	f.disk("pci0/ata1/host0/target0:0:0/0:0:0:0", "sda", map[string]string{
+		"removable": "0", "ro": "0", "size": sectors(500 << 30),
+		"queue/logical_block_size": "512", "queue/physical_block_size": "4096",
+		"device/model": "Samsung SSD 860", "device/vendor": "ATA", "device/serial": "S3Z9NB0K123456",
+	})
+	f.partition("sda", "sda1", map[string]string{"size": sectors(100 << 20)})
+
+	usb := "pci0/usb1/1-1/1-1:1.0/host6/target6:0:0/6:0:0:0"
+	f.disk(usb, "sdb", map[string]string{
+		"removable": "1", "size": sectors(16 << 30),
+		"queue/logical_block_size": "512", "queue/physical_block_size": "512",
+	})
+	dev := filepath.Join(f.root, "devices", usb)
+	f.write(dev, map[string]string{"model": "Cruzer Blade", "vendor": "SanDisk"})
+	f.write(filepath.Join(f.root, "devices", "pci0/usb1/1-1"), map[string]string{"serial": "4C530001230512345678"})
+	if err := os.Symlink("../..", filepath.Join(f.dirs["sdb"], "device")); err != nil {
+		t.Fatal(err)
+	}
+
+	f.disk("pci0/mmc_host/mmc0/mmc0:0001", "mmcblk0", map[string]string{
+		"removable": "0", "size": sectors(32 << 30), "device/serial": "0x1234abcd",
+	})
+	f.holder("mmcblk0", "dm-0")
+	f.disk("platform/floppy.0", "fd0", map[string]string{"removable": "1", "size": sectors(1440 << 10)})
+	f.disk("pci0/ata2/host1/target1:0:0/1:0:0:0", "sr0", map[string]string{"removable": "1", "ro": "1", "size": "0"})
+	f.disk("virtual", "loop0", map[string]string{"removable": "0", "size": "0"})
+	return f
+}
+
+func TestDiscoverSysfs(t *testing.T) {
+	f := testSysfs(t)
+	devs, err := discoverSysfs(f.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*blockDevice{}
+	var names []string
+	for _, b := range devs {
+		byName[b.Name] = b
+		names = append(names, b.Name)
+	}
+	want := []string{"fd0", "loop0", "mmcblk0", "sda", "sda1", "sdb", "sr0"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("devices %v, want %v", names, want)
+	}
+
+	sda := byName["sda"]
+	wantSda := blockDevice{
+		Name: "sda", Size: 500 << 30, LogicalSectorSize: 512, PhysicalSectorSize: 4096,
+		Model: "Samsung SSD 860", Vendor: "ATA", Serial: "S3Z9NB0K123456", Transport: "sata",
+		Partitions: []string{"sda1"},
+	}
+	if !reflect.DeepEqual(*sda, wantSda) {
+		t.Errorf("sda = %+v\nwant  %+v", *sda, wantSda)
+	}
+	if p := byName["sda1"]; !p.Partition || p.Parent != "sda" || p.Size != 100<<20 || p.Serial != sda.Serial {
+		t.Errorf("sda1 = %+v, want a 100M partition of sda with its serial", *p)
+	}
+	if b := byName["sdb"]; !b.Removable || b.Transport != "usb" || b.Serial != "4C530001230512345678" || b.Model != "Cruzer Blade" {
+		t.Errorf("sdb = %+v, want a removable USB disk with the USB device's serial", *b)
+	}
+	if b := byName["mmcblk0"]; b.Transport != "mmc" || !reflect.DeepEqual(b.Holders, []string{"dm-0"}) {
+		t.Errorf("mmcblk0 = %+v, want an MMC card held by dm-0", *b)
+	}
+	if b := byName["fd0"]; b.Transport != "floppy" || b.Size != 1440<<10 {
+		t.Errorf("fd0 = %+v, want a 1.44M floppy", *b)
+	}
+	if b := byName["loop0"]; b.Transport != "virtual" {
+		t.Errorf("loop0 transport %q, want virtual", b.Transport)
+	}
+	if b := byName["sr0"]; !b.ReadOnly {
+		t.Errorf("sr0 = %+v, want read-only", *b)
+	}
+}
+
+func TestBlockDeviceInfos(t *testing.T) {
+	f := testSysfs(t)
+	infos, err := blockDeviceInfos(f.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compatible := map[string]string{}
+	for _, d := range infos {
+		compatible[d.Path] = d.Reason
+		if d.Compatible {
+			compatible[d.Path] = "ok"
+		}
+	}
+	want := map[string]string{
+		"/dev/fd0":     "ok",
+		"/dev/loop0":   "unused loop device",
+		"/dev/mmcblk0": "in use by dm-0",
+		"/dev/sda":     "ok",
+		"/dev/sda1":    "partition of sda",
+		"/dev/sdb":     "ok",
+		"/dev/sr0":     "read-only",
+	}
+	if !reflect.DeepEqual(compatible, want) {
+		t.Errorf("compatibility %v\nwant          %v", compatible, want)
+	}
+
+	// device list --json prints the infos as they are.
+	var buf bytes.Buffer
+	if err := writeStructured(&buf, infos, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []struct {
+		Path       string `json:"path"`
+		Compatible bool   `json:"compatible"`
+		Block      struct {
+			Name      string `json:"name"`
+			Size      int64  `json:"size"`
+			Removable bool   `json:"removable"`
+			Serial    string `json:"serial"`
+			Transport string `json:"transport"`
+		} `json:"block"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("device list JSON does not parse: %v\n%s", err, buf.String())
+	}
+	var sdb bool
+	for _, d := range decoded {
+		if d.Path != "/dev/sdb" {
+			continue
+		}
+		sdb = true
+		b := d.Block
+		if !d.Compatible || b.Name != "sdb" || b.Size != 16<<30 || !b.Removable || b.Serial != "4C530001230512345678" || b.Transport != "usb" {
+			t.Errorf("JSON for /dev/sdb = %+v", d)
+		}
+	}
+	if len(decoded) != len(infos) || !sdb {
+		t.Errorf("JSON has %d devices (sdb %t), want %d", len(decoded), sdb, len(infos))
+	}
+}
+
+func TestFilterDevices(t *testing.T) {
+	f := testSysfs(t)
+	infos, err := blockDeviceInfos(f.root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos = append(infos, deviceInfo{Path: "/dev/disk9", Compatible: true}) // no sysfs data
+	tests := []struct {
+		name      string
+		removable bool
+		maxSize   int64
+		want      []string
+	}{
+		{"no filter", false, 0, []string{"/dev/fd0", "/dev/loop0", "/dev/mmcblk0", "/dev/sda", "/dev/sda1", "/dev/sdb", "/dev/sr0", "/dev/disk9"}},
+		{"removable", true, 0, []string{"/dev/fd0", "/dev/sdb", "/dev/sr0"}},
+		{"max size", false, 32 << 30, []string{"/dev/fd0", "/dev/loop0", "/dev/mmcblk0", "/dev/sda1", "/dev/sdb", "/dev/sr0"}},
+		{"removable and max size", true, 1 << 30, []string{"/dev/fd0", "/dev/sr0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, d := range filterDevices(infos, tt.removable, tt.maxSize) {
+				got = append(got, d.Path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterDevices = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentifyPartition(t *testing.T) {
+	f := testSysfs(t)
+	g := newDeviceGuard()
+	g.SysfsRoot = f.root
+	// The device path does not exist, so only its name is used.
+	id := g.identify(filepath.Join(t.TempDir(), "sda1"))
+	want := deviceIdentity{Name: "sda1", Model: "Samsung SSD 860", Vendor: "ATA", Serial: "S3Z9NB0K123456", Size: 100 << 20}
+	id.Path = ""
+	if id != want {
+		t.Errorf("identify(sda1) = %+v\nwant %+v", id, want)
+	}
+}
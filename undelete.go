@@ -0,0 +1,460 @@
+// undelete.go
+// Recovery of directory entries marked deleted (0xE5). Deleting a file on
+// FAT only overwrites the first byte of its name and frees its chain, so a
+// file whose clusters have not been reused can be rebuilt from the start
+// cluster and size, assuming it was stored contiguously.
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/spf13/cobra"
+)
+
+// deletedEntry is a deleted short entry with what could be recovered of it.
+type deletedEntry struct {
+	Dir     uint32 // directory cluster, 0 for the root
+	DirPath string // volume path of the directory, e.g. "::/DOS"
+	Slot    int
+	LFNSlot int // first slot of the deleted LFN run, equal to Slot without one
+	Short   [11]byte
+	Long    string // recovered long name, empty if none survived
+	Attr    uint8
+	Cluster uint32
+	Size    uint32
+	Mod     time.Time
+	Letter  byte // guessed or given first letter, 0 if unknown
+}
+
+// shortWith returns the short name with its first byte set to letter.
+func (d deletedEntry) shortWith(letter byte) [11]byte {
+	s := d.Short
+	s[0] = letter
+	return s
+}
+
+// name is the long name if one survived, else the 8.3 name with "?" for an
+// unknown first letter.
+func (d deletedEntry) name() string {
+	if d.Long != "" {
+		return d.Long
+	}
+	letter := d.Letter
+	if letter == 0 {
+		letter = '?'
+	}
+	return shortDisplayName(d.shortWith(letter), false)
+}
+
+// scanDeleted collects deleted entries in the directory at cluster and,
+// recursively, in its live subdirectories. Every directory cluster is
+// visited once, so a subdirectory pointing back into an ancestor is
+// reported and skipped instead of being walked forever.
+func (v *fatVolume) scanDeleted(cluster uint32, dirPath string) ([]deletedEntry, error) {
+	return v.scanDeletedIn(cluster, dirPath, map[uint32]string{})
+}
+
+func (v *fatVolume) scanDeletedIn(cluster uint32, dirPath string, seen map[uint32]string) ([]deletedEntry, error) {
+	start := cluster
+	if start == 0 && v.ft == FAT32 {
+		start = v.g.RootCluster
+	}
+	if start != 0 {
+		chain, _ := v.chain(start)
+		for _, c := range chain {
+			if other, dup := seen[c]; dup {
+				fmt.Fprintf(os.Stderr, "WARNING: %s: cross-linked with %s at cluster %d, not scanned\n", dirPath, other, c)
+				return []deletedEntry{}, nil
+			}
+		}
+		for _, c := range chain {
+			seen[c] = dirPath
+		}
+	}
+	d, err := v.readDir(cluster)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dirPath, err)
+	}
+	out := []deletedEntry{}
+	for i := 0; i*32 < len(d.data); i++ {
+		raw := d.data[i*32 : i*32+32]
+		if raw[0] == 0x00 {
+			break
+		}
+		if raw[0] != 0xE5 || raw[11] == attrLFN || raw[11]&attrVolumeID != 0 {
+			continue
+		}
+		e := decodeDirEntry(raw, i)
+		de := deletedEntry{
+			Dir: cluster, DirPath: dirPath, Slot: i, LFNSlot: i, Short: e.Short,
+			Attr: e.Attr, Cluster: e.Cluster, Size: e.Size, Mod: e.Mod,
+		}
+		de.Long, de.LFNSlot, de.Letter = deletedLongName(d, i, de.Short)
+		out = append(out, de)
+	}
+	for _, e := range d.entries() {
+		if !e.isDir() || e.isDotDir() || e.Cluster == 0 {
+			continue
+		}
+		sub, err := v.scanDeletedIn(e.Cluster, strings.TrimSuffix(dirPath, "/")+"/"+e.Name, seen)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, sub...)
+	}
+	return out, nil
+}
+
+// deletedLongName rebuilds the long name from the deleted LFN entries in
+// front of slot. Their sequence bytes are gone, but the characters and the
+// checksum survive; the checksum also tells which first letter the short
+// name had. It returns the name, the first LFN slot and the letter.
+func deletedLongName(d *fatDir, slot int, short [11]byte) (string, int, byte) {
+	units := []uint16{}
+	first := slot
+	var sum byte
+	for j := slot - 1; j >= 0; j-- {
+		raw := d.data[j*32 : j*32+32]
+		if raw[0] != 0xE5 || raw[11] != attrLFN || (first != slot && raw[13] != sum) {
+			break
+		}
+		sum = raw[13]
+		first = j
+		for _, o := range lfnCharOffsets {
+			units = append(units, binary.LittleEndian.Uint16(raw[o:]))
+		}
+	}
+	if first == slot {
+		return "", slot, 0
+	}
+	for i, u := range units {
+		if u == 0x0000 {
+			units = units[:i]
+			break
+		}
+	}
+	long := string(utf16.Decode(units))
+	matches := func(c byte) bool {
+		s := short
+		s[0] = c
+		return lfnChecksum(s) == sum
+	}
+	// The short name usually starts with the first letter of the long one.
+	if r := []rune(long); len(r) > 0 {
+		if c := unicode.ToUpper(r[0]); c < 0x80 && validShortChar(c) && matches(byte(c)) {
+			return long, first, byte(c)
+		}
+	}
+	for _, c := range []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_$~!#%&-{}()@'`^") {
+		if matches(c) {
+			return long, first, c
+		}
+	}
+	// Nothing fits: the LFN entries belonged to some other file.
+	return "", slot, 0
+}
+
+// deletedStatus reports whether d can be restored. claimed holds clusters
+// already given to entries restored earlier in the same run.
+func (v *fatVolume) deletedStatus(d deletedEntry, claimed map[uint32]bool) (string, bool) {
+	if d.Attr&attrDir != 0 {
+		return "directory, not restorable", false
+	}
+	if d.Size == 0 {
+		return "empty, restorable", true
+	}
+	if !v.validCluster(d.Cluster) {
+		return "bad start cluster", false
+	}
+	n := uint32(v.clustersFor(int64(d.Size)))
+	if d.Cluster+n > v.clusters+2 {
+		return "runs past the end of the volume", false
+	}
+	for c := d.Cluster; c < d.Cluster+n; c++ {
+		if v.entry(c) != 0 || claimed[c] {
+			return fmt.Sprintf("overwritten (cluster %d in use)", c), false
+		}
+	}
+	return "restorable", true
+}
+
+// writeDeletedData copies the contiguous clusters of d to w.
+func (v *fatVolume) writeDeletedData(d deletedEntry, w io.Writer) error {
+	buf := make([]byte, v.clusterBytes())
+	remain := int64(d.Size)
+	for c := d.Cluster; remain > 0; c++ {
+		if _, err := v.r.ReadAt(buf, v.clusterSector(c)*v.bps()); err != nil {
+			return fmt.Errorf("read cluster %d: %w", c, err)
+		}
+		n := min(remain, int64(len(buf)))
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		remain -= n
+	}
+	return nil
+}
+
+// restoreToHost writes the data of d below hostDir, mirroring its directory.
+func (v *fatVolume) restoreToHost(d deletedEntry, hostDir string) (string, error) {
+	dir := hostDir
+	for _, part := range splitFATPath(d.DirPath) {
+		dir = filepath.Join(dir, hostSafeName(part))
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, hostSafeName(d.name()))
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return "", err
+	}
+	if err := v.writeDeletedData(d, out); err != nil {
+		out.Close()
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if !d.Mod.IsZero() {
+		_ = os.Chtimes(dst, d.Mod, d.Mod)
+	}
+	return dst, nil
+}
+
+// restoreInVolume relinks the clusters of d and revives its directory
+// entry with d.Letter, long name included when that is the letter the LFN
+// checksum asks for. It returns the name the file got.
+func (v *fatVolume) restoreInVolume(d deletedEntry) (string, error) {
+	dir, err := v.readDir(d.Dir)
+	if err != nil {
+		return "", err
+	}
+	// Pick a first letter that does not collide with a live entry.
+	candidates := append([]byte{d.Letter}, []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_")...)
+	short := [11]byte{}
+	letter, found := byte(0), false
+	for _, c := range candidates {
+		short = d.shortWith(c)
+		if _, taken := findEntry(dir, shortDisplayName(short, false)); !taken {
+			letter, found = c, true
+			break
+		}
+	}
+	if !found {
+		return "", fmt.Errorf("no free name for %s", d.name())
+	}
+	withLFN := d.Long != "" && letter == d.Letter && lfnChecksum(short) == dir.data[d.LFNSlot*32+13]
+	if withLFN {
+		if _, taken := findEntry(dir, d.Long); taken {
+			withLFN = false
+		}
+	}
+
+	if d.Size > 0 {
+		n := uint32(v.clustersFor(int64(d.Size)))
+		for c := d.Cluster; c < d.Cluster+n; c++ {
+			next := c + 1
+			if c == d.Cluster+n-1 {
+				next = v.eocMark()
+			}
+			v.setEntry(c, next)
+		}
+		if err := v.flush(); err != nil {
+			return "", err
+		}
+	}
+	if withLFN {
+		total := d.Slot - d.LFNSlot
+		for j := d.LFNSlot; j < d.Slot; j++ {
+			raw := append([]byte(nil), dir.data[j*32:j*32+32]...)
+			raw[0] = byte(d.Slot - j)
+			if j == d.LFNSlot {
+				raw[0] = byte(total) | 0x40
+			}
+			if err := v.writeSlots(dir, j, raw); err != nil {
+				return "", err
+			}
+		}
+	}
+	raw := append([]byte(nil), dir.data[d.Slot*32:d.Slot*32+32]...)
+	raw[0] = letter
+	if err := v.writeSlots(dir, d.Slot, raw); err != nil {
+		return "", err
+	}
+	if withLFN {
+		return d.Long, nil
+	}
+	return shortDisplayName(short, false), nil
+}
+
+// copyVolume copies the whole of src to a new image file at dst.
+func copyVolume(src *os.File, dst string) (*os.File, error) {
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	size, err := getDeviceSize(src)
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(src, 0, size))
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(dst)
+		return nil, fmt.Errorf("copy to %s: %w", dst, err)
+	}
+	return out, nil
+}
+
+func newUndeleteCmd() *cobra.Command {
+	var toDir, toImage, match, firstLetter string
+	var inPlace bool
+	guard := newDeviceGuard()
+	cmd := &cobra.Command{
+		Use:   "undelete <image|device> [::/dir]",
+		Short: "List and recover deleted files on a FAT12/16/32 image or device",
+		Long: "List the deleted entries under a directory (the root by default) and,\n" +
+			"with --to-dir, --to-image or --in-place, recover the ones whose clusters\n" +
+			"are still free. Files are assumed to have been stored contiguously.\n\n" +
+			"The first letter of a deleted 8.3 name is lost; it is recovered from the\n" +
+			"long name when one survived; give it with --first-letter for the others\n" +
+			"(\"_\" is used when restoring without one).\n" +
+			"The source is only modified with --in-place.",
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(_ *cobra.Command, args []string) (err error) {
+			modes := 0
+			for _, set := range []bool{toDir != "", toImage != "", inPlace} {
+				if set {
+					modes++
+				}
+			}
+			if modes > 1 {
+				return errors.New("use only one of --to-dir, --to-image and --in-place")
+			}
+			firstLetter = strings.ToUpper(firstLetter)
+			if len(firstLetter) > 1 || (firstLetter != "" && !validShortChar(rune(firstLetter[0]))) {
+				return fmt.Errorf("--first-letter must be a single valid 8.3 character, got %q", firstLetter)
+			}
+			f, v, err := openVolumeFile(args[0], inPlace, guard)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			if inPlace {
+				audit := newVolumeAudit("undelete", args[0])
+				defer func() { audit.finish(err) }()
+			}
+			if toImage != "" {
+				out, err := copyVolume(f, toImage)
+				if err != nil {
+					return err
+				}
+				defer out.Close()
+				if v, err = openFATVolume(out, out); err != nil {
+					return err
+				}
+			}
+
+			start := "::/"
+			if len(args) == 2 {
+				start = args[1]
+			}
+			de, err := v.lookup(start)
+			if err != nil {
+				return err
+			}
+			if !de.isDir() {
+				return fmt.Errorf("%s is not a directory", start)
+			}
+			dirPath := "::/" + strings.Join(splitFATPath(start), "/")
+			all, err := v.scanDeleted(de.Cluster, dirPath)
+			if err != nil {
+				return err
+			}
+
+			restoring := modes == 1
+			claimed := map[uint32]bool{}
+			found, ok, restored := 0, 0, 0
+			fmt.Printf("Deleted entries under %s\n\n", dirPath)
+			for _, d := range all {
+				if d.Letter == 0 && firstLetter != "" {
+					d.Letter = firstLetter[0]
+				}
+				full := strings.TrimSuffix(d.DirPath, "/") + "/" + d.name()
+				if match != "" {
+					if m, _ := path.Match(strings.ToUpper(match), strings.ToUpper(d.name())); !m {
+						continue
+					}
+				}
+				found++
+				status, can := v.deletedStatus(d, claimed)
+				date := "                "
+				if !d.Mod.IsZero() {
+					date = d.Mod.Format("2006-01-02 15:04")
+				}
+				fmt.Printf("%10d  %s  %8d  %-28s %s\n", d.Size, date, d.Cluster, status, full)
+				if !can {
+					continue
+				}
+				ok++
+				if !restoring {
+					continue
+				}
+				n := uint32(v.clustersFor(int64(d.Size)))
+				if d.Size == 0 {
+					n = 0
+				}
+				for c := d.Cluster; c < d.Cluster+n; c++ {
+					claimed[c] = true
+				}
+				if d.Letter == 0 {
+					d.Letter = '_'
+				}
+				if toDir != "" {
+					dst, err := v.restoreToHost(d, toDir)
+					if err != nil {
+						return fmt.Errorf("%s: %w", full, err)
+					}
+					fmt.Printf("%38s-> %s\n", "", dst)
+				} else {
+					name, err := v.restoreInVolume(d)
+					if err != nil {
+						return fmt.Errorf("%s: %w", full, err)
+					}
+					fmt.Printf("%38s-> %s/%s\n", "", strings.TrimSuffix(d.DirPath, "/"), name)
+				}
+				restored++
+			}
+			fmt.Printf("\n%d deleted entr(ies), %d restorable", found, ok)
+			if restoring {
+				where := "in place"
+				switch {
+				case toDir != "":
+					where = "to " + toDir
+				case toImage != "":
+					where = "into " + toImage
+				}
+				fmt.Printf(", %d restored %s", restored, where)
+			}
+			fmt.Println()
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&toDir, "to-dir", "", "write recovered files below this host directory")
+	cmd.Flags().StringVar(&toImage, "to-image", "", "copy the volume to this new image and recover the files there")
+	cmd.Flags().BoolVar(&inPlace, "in-place", false, "recover the files on the source itself")
+	guard.addInUseFlags(cmd)
+	cmd.Flags().StringVar(&match, "match", "", "only entries whose name matches this pattern (e.g. \"*.TXT\")")
+	cmd.Flags().StringVar(&firstLetter, "first-letter", "", "first letter for deleted 8.3 names that cannot be guessed")
+	return cmd
+}